@@ -0,0 +1,41 @@
+package dexec
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestArgsTooLong(t *testing.T) {
+	many := make([]string, 100000)
+	for i := range many {
+		many[i] = "some/file/name.txt"
+	}
+	for _, tt := range []struct {
+		name      string
+		args, env []string
+		expected  bool
+	}{
+		{"short", []string{"echo", "foo"}, []string{"A=B"}, false},
+		{"long arg", []string{"echo", strings.Repeat("x", maxArgLen)}, nil, true},
+		{"long env", []string{"env"}, []string{"A=" + strings.Repeat("x", maxArgLen)}, true},
+		{"max arg", []string{"echo", strings.Repeat("x", maxArgLen-1)}, nil, false},
+		{"many args", append([]string{"rm"}, many...), nil, true},
+		{"many args in env", []string{"env"}, many, true},
+	} {
+		if got := argsTooLong(tt.args, tt.env); got != tt.expected {
+			t.Errorf("%s: argsTooLong() = %v; expected %v", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestUmaskCommand(t *testing.T) {
+	got := umaskCommand(0002, []string{"touch", "/tmp/a b"})
+	want := []string{"/bin/sh", "-c", `umask 0002 && exec "$@"`, "/bin/sh", "touch", "/tmp/a b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q; expected %q", got, want)
+	}
+	if got := umaskCommand(0777, nil)[2]; got != `umask 0777 && exec "$@"` {
+		t.Fatalf("got script %q", got)
+	}
+}
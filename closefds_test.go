@@ -0,0 +1,52 @@
+package dexec
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+type recordingCloser struct {
+	name  string
+	err   error
+	order *[]string
+}
+
+func (r recordingCloser) Close() error {
+	*r.order = append(*r.order, r.name)
+	return r.err
+}
+
+func TestCloseFdsOrder(t *testing.T) {
+	var order []string
+	err := closeFds([]io.Closer{
+		recordingCloser{"a", nil, &order},
+		recordingCloser{"b", nil, &order},
+		recordingCloser{"c", nil, &order},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, expected := order, []string{"c", "b", "a"}; len(got) != 3 ||
+		got[0] != expected[0] || got[1] != expected[1] || got[2] != expected[2] {
+		t.Fatalf("closed in order %v; expected %v", got, expected)
+	}
+}
+
+func TestCloseFdsErrors(t *testing.T) {
+	var order []string
+	err := closeFds([]io.Closer{
+		recordingCloser{"a", errors.New("err a"), &order},
+		recordingCloser{"b", nil, &order},
+		recordingCloser{"c", errors.New("err c"), &order},
+	})
+	if len(order) != 3 {
+		t.Fatalf("closed %v; expected all handles to be closed", order)
+	}
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if expected := "dexec: error closing handles: err c; err a"; err.Error() != expected {
+		t.Fatalf("got error %q; expected %q", err, expected)
+	}
+}
@@ -1,16 +1,59 @@
 package dexec
 
 import (
-	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 )
 
+var (
+	// ErrNilClient is returned by Cmd.Start if the Cmd is created from a
+	// Docker value without a *docker.Client.
+	ErrNilClient = errors.New("dexec: Docker.Client is nil")
+
+	// ErrNilMethod is returned by Cmd.Start if Cmd.Method is not set.
+	ErrNilMethod = errors.New("dexec: Method is nil")
+
+	// ErrDetached is returned by Cmd.Wait if Cmd.Detach is called or the
+	// Cmd.DetachKeys sequence is read from Cmd.Stdin.
+	ErrDetached = errors.New("dexec: detached from container")
+
+	// ErrArgListTooLong is returned by Cmd.Start if the command line and
+	// environment exceed the limits of execve(2) on Linux, which would make
+	// the command fail to start in the container. They are checked as passed
+	// to Docker, including any kept entrypoint and Config.Env.
+	ErrArgListTooLong = errors.New("dexec: argument list too long")
+
+	// ErrIdleTimeout is returned by Cmd.Wait if the command is killed for
+	// producing no output for Cmd.IdleTimeout.
+	ErrIdleTimeout = errors.New("dexec: command produced no output within idle timeout")
+
+	// ErrKilled is returned by Cmd.Wait if the command is killed by
+	// Cmd.Kill.
+	ErrKilled = errors.New("dexec: command killed")
+)
+
+// Limits of execve(2) on Linux with the default 8 MiB stack size.
+const (
+	maxArgLen  = 128 * 1024      // MAX_ARG_STRLEN, for a single argument
+	maxArgsLen = 2 * 1024 * 1024 // ARG_MAX, for arguments and environment
+)
+
 // Docker contains connection to Docker API.
 // Use github.com/fsouza/go-dockerclient to initialize *docker.Client.
+//
+// A single Docker value can be used to create and run any number of Cmds
+// concurrently from multiple goroutines. A Cmd and its Method, however,
+// must not be used from multiple goroutines, except for calling Detach
+// while another goroutine blocks in Wait, calling Kill or Signal at any time,
+// and calling Resize once Start has returned.
 type Docker struct {
 	*docker.Client
 }
@@ -23,6 +66,18 @@ func (d Docker) Command(method Execution, name string, arg ...string) *Cmd {
 	return &Cmd{Method: method, Path: name, Args: arg, docker: d}
 }
 
+// DefaultShell is the shell used by CommandShell to run scripts.
+const DefaultShell = "/bin/sh"
+
+// CommandShell returns the Cmd struct to execute the given shell script with
+// DefaultShell as in:
+//     /bin/sh -c "script"
+// The container image must provide the shell. To use a different shell,
+// change Path of the returned Cmd.
+func (d Docker) CommandShell(method Execution, script string) *Cmd {
+	return d.Command(method, DefaultShell, "-c", script)
+}
+
 // Cmd represents an external command being prepared or run.
 //
 // A Cmd cannot be reused after calling its Run, Output or CombinedOutput
@@ -43,8 +98,18 @@ type Cmd struct {
 	// Env specified on Method or pre-built container image.
 	Env []string
 
+	// InheritEnv lists names of environment variables to pass from the
+	// current process to the command, in addition to Env or, if Env is nil,
+	// Config.Env in the options of Method. Variables set explicitly in either
+	// take precedence and variables not set in the current process are
+	// skipped.
+	InheritEnv []string
+
 	// Dir specifies the working directory of the command. If Dir is the empty
 	// string, Run uses Dir specified on Method or pre-built container image.
+	//
+	// Dir must be an absolute path, otherwise Start fails. It is not checked
+	// whether Dir exists in the image; Docker creates it if it does not.
 	Dir string
 
 	// Stdin specifies the process's standard input.
@@ -59,16 +124,218 @@ type Cmd struct {
 	//
 	// Run will not close the underlying handles if they are *os.File differently
 	// than os/exec.
+	//
+	// Both fields can be set independently, for instance to redirect only
+	// Stdout to a file. Output and StdoutPipe require Stdout to be nil, and
+	// StderrPipe requires Stderr to be nil; CombinedOutput requires both to be
+	// nil. Output leaves a non-nil Stderr in place.
+	//
+	// Data is written to each of them in the order the command produced it,
+	// however there is no ordering guarantee between the two streams. If a
+	// write fails, the rest of that stream is discarded so that the command
+	// can still run to completion, and Wait reports the write error.
 	Stdout io.Writer
 	Stderr io.Writer
 
+	// KeepContainer, if true, prevents Wait from removing the container after
+	// the command exits, so that it can be inspected for debugging purposes.
+	// The ID of the retained container is logged. The caller becomes
+	// responsible for removing the container by calling Cleanup.
+	KeepContainer bool
+
+	// KeepKilledContainer is like KeepContainer, but retains the container
+	// only if the command is killed by Kill or for exceeding IdleTimeout, to
+	// diagnose why it hung. Otherwise Wait removes the container as usual.
+	// The retained container has exited, so it no longer uses CPU or memory,
+	// but its filesystem remains until it is removed by calling Cleanup.
+	KeepKilledContainer bool
+
+	// RequireDigest, if true, makes Start fail unless the container image is
+	// referenced by a content digest (e.g. "busybox@sha256:...") rather than
+	// a tag, which may change over time. Digest references are always passed
+	// to Docker verbatim.
+	RequireDigest bool
+
+	// CheckBindSources, if true, makes Start fail with a *MountSourceError if
+	// the host path of a bind in HostConfig.Binds or a bind mount in
+	// HostConfig.Mounts does not exist, instead of letting Docker create an
+	// empty directory in its place. It requires the Docker engine to run on
+	// the same host, as the paths are checked locally.
+	CheckBindSources bool
+
+	// RequireNativePlatform, if true, makes Start fail if the container image
+	// is built for a different OS or architecture than the Docker engine, such
+	// as a linux/amd64 image on an arm64 host. Docker would otherwise run the
+	// command under emulation, which is much slower, or fail to run it if no
+	// emulator is installed. Images not present on the engine are not checked.
+	RequireNativePlatform bool
+
+	// OnCleanupError, if not nil, is called when removing the container fails
+	// in a code path where the error cannot be returned, such as after Wait
+	// has already failed. If OnCleanupError is nil, such errors are logged
+	// with the standard logger of package log, which writes to standard
+	// error unless redirected with log.SetOutput. Besides notices that a
+	// container is retained or stopped, this is the only output dexec
+	// produces itself.
+	OnCleanupError func(containerID string, err error)
+
+	// OnOutput, if not nil, is called for every line of the command's
+	// standard output and error along with the time it is received, in
+	// addition to writing the output to Stdout and Stderr. Calls are not
+	// made concurrently. A final line without a trailing newline is passed
+	// once the command exits.
+	OnOutput func(line OutputLine)
+
+	// OnEvent, if set, is called with the events Docker reports for the
+	// container, such as "oom" when the command exceeds its memory limit, to
+	// correlate failures with resource pressure. Calls are not made
+	// concurrently. Events are watched from before the container starts
+	// until Wait observes the command exit, including the final "die"
+	// event, until the command is detached, or until the container is
+	// removed.
+	OnEvent func(event ContainerEvent)
+
+	// StopTimeout, if positive, is how long the command is given to exit
+	// after receiving SIGTERM when its container is removed while it is still
+	// running, such as by Cleanup after Detach or when Wait fails. It is then
+	// killed with SIGKILL. The timeout is rounded up to whole seconds. If
+	// StopTimeout is zero, the command is killed right away. Stopping, and
+	// killing after the timeout, are logged with the standard logger of
+	// package log.
+	StopTimeout time.Duration
+
+	// IdleTimeout, if positive, is how long the command may run without
+	// writing to standard output or standard error, counted from Start. If
+	// it is exceeded, the command is killed and Wait returns ErrIdleTimeout.
+	// It detects hung commands well before a wall-clock deadline would.
+	IdleTimeout time.Duration
+
+	// StdinEOFTimeout, if positive, is how long the command may keep running
+	// after reading Stdin to EOF, for commands that are expected to exit
+	// once their input ends. If it is exceeded, the command is stopped like
+	// on removal: it receives SIGTERM, or Config.StopSignal if set, and
+	// SIGKILL after StopTimeout. Wait then reports the resulting exit code.
+	// StdinEOFTimeout has no effect if Stdin is nil.
+	StdinEOFTimeout time.Duration
+
+	// KeepEntrypoint, if true, preserves the entrypoint of the container
+	// (set on the image or in Config.Entrypoint of Method) and passes Path
+	// and Args to it as arguments. By default, Path and Args replace the
+	// entrypoint.
+	KeepEntrypoint bool
+
+	// Umask, if set, is the file mode creation mask of the command, such as
+	// 0002 for group-writable files, instead of the default of the container
+	// (usually 0022). Docker has no setting for it, so the command is started
+	// through DefaultShell, which the image must provide, to set the mask.
+	// Umask cannot be used with KeepEntrypoint.
+	Umask *os.FileMode
+
+	// AttachTimeout, if positive, limits how long Start waits for the
+	// connection to the container's streams to be established. If it times
+	// out, the container is removed and Start returns an error. If
+	// AttachTimeout is zero, Start waits indefinitely.
+	AttachTimeout time.Duration
+
+	// MaxOutputBytes, if positive, limits how many bytes Output and
+	// ExecuteAndWait capture from each stream, and CombinedOutput from both
+	// streams together. Output beyond the limit is read from the container
+	// and discarded, and ErrOutputTruncated is returned unless the command
+	// fails otherwise.
+	MaxOutputBytes int64
+
+	// Secrets are files to make available to the command, such as
+	// credentials, without passing them through the environment. They are
+	// written to a directory only accessible by the current user, on a memory
+	// backed file system if available, and bind-mounted read-only into the
+	// container. Therefore the Docker engine must run on the same host.
+	//
+	// The files are removed along with the container, by Wait, by Cleanup if
+	// KeepContainer is set, or by Start if it fails. If the command is
+	// detached, the files stay on the host until Cleanup is called.
+	Secrets []Secret
+
+	// DetachKeys, if set, overrides the key sequence that detaches from the
+	// container when read from Stdin, such as "ctrl-p,ctrl-q". Each key is
+	// a single character or "ctrl-<value>", where <value> is a letter or one
+	// of @, [, \, ], ^ or _. Docker only honors detach keys if the container
+	// has a terminal, so Config.Tty must be set in the options of Method.
+	//
+	// Detaching this way has the same effect as calling Detach: Wait returns
+	// ErrDetached, and the container keeps running and is not removed. It is
+	// meant for interactive sessions where a human at Stdin leaves a command
+	// running to be reattached with the docker CLI or removed with Cleanup.
+	// Wait reports it only if the sequence was read from Stdin and the
+	// container is still running a second after its streams end.
+	//
+	// If DetachKeys is empty, the default of the Docker engine applies
+	// (usually ctrl-p,ctrl-q), but detaching with it is not recognized: Wait
+	// keeps waiting for the command to exit, then removes the container.
+	DetachKeys string
+
+	// TTYWidth and TTYHeight, if set, are the initial size of the terminal
+	// in columns and rows, applied by Start. They require Config.Tty to be
+	// set in the options of Method. Use Resize to change the size later.
+	TTYWidth, TTYHeight uint16
+
+	// StderrTail, if positive, makes Wait retain the last StderrTail bytes
+	// written to standard error and return them in ExitError.Stderr if the
+	// command fails, in addition to writing them to Stderr. It provides
+	// context for failures without capturing all output.
+	StderrTail int
+
 	docker         Docker
 	started        bool
 	closeAfterWait []io.Closer
+	stdoutTees     []io.Writer
+	stderrTees     []io.Writer
+	outputs        []*discardOnError
+	lines          []*lineWriter
+	stderrTail     *tailBuffer
+	stdinMode      streamMode
+	stdoutMode     streamMode
+	stderrMode     streamMode
 }
 
 // Start starts the specified command but does not wait for it to complete.
+//
+// If Start fails, it closes the file opened by SetStdinFile and the pipes
+// created by StdoutPipe and StderrPipe, as Wait would. Writers passed to
+// SetStdoutCloser and SetStderrCloser are not closed.
 func (c *Cmd) Start() error {
+	started := c.started
+	err := c.start()
+	if err != nil && !started {
+		var l []io.Closer
+		for _, h := range c.closeAfterWait {
+			if _, ok := h.(callerCloser); !ok {
+				l = append(l, h)
+			}
+		}
+		closeFds(l)
+		c.closeAfterWait = nil
+	}
+	return err
+}
+
+func (c *Cmd) start() error {
+	if c.docker.Client == nil {
+		return ErrNilClient
+	}
+	if c.Method == nil {
+		return ErrNilMethod
+	}
+	if c.Path == "" {
+		return errors.New("dexec: Path is empty")
+	}
+	if c.Umask != nil {
+		if *c.Umask&^0777 != 0 {
+			return fmt.Errorf("dexec: invalid Umask %#o", *c.Umask)
+		}
+		if c.KeepEntrypoint {
+			return errors.New("dexec: Umask cannot be used with KeepEntrypoint")
+		}
+	}
 	if c.Dir != "" {
 		if err := c.Method.setDir(c.Dir); err != nil {
 			return err
@@ -79,6 +346,87 @@ func (c *Cmd) Start() error {
 			return err
 		}
 	}
+	if env := c.inheritedEnv(); len(env) > 0 {
+		if err := c.Method.setInheritedEnv(env); err != nil {
+			return err
+		}
+	}
+
+	if c.KeepContainer {
+		if err := c.Method.setKeep(true); err != nil {
+			return err
+		}
+	}
+	if c.KeepKilledContainer {
+		if err := c.Method.setKeepKilled(true); err != nil {
+			return err
+		}
+	}
+	if c.OnEvent != nil {
+		if err := c.Method.setEventHandler(c.OnEvent); err != nil {
+			return err
+		}
+	}
+	if c.RequireNativePlatform {
+		if err := c.Method.setRequireNativePlatform(true); err != nil {
+			return err
+		}
+	}
+	if c.CheckBindSources {
+		if err := c.Method.setCheckBindSources(true); err != nil {
+			return err
+		}
+	}
+	if c.RequireDigest {
+		if err := c.Method.setRequireDigest(true); err != nil {
+			return err
+		}
+	}
+	if c.OnCleanupError != nil {
+		if err := c.Method.setCleanupErrorHook(c.OnCleanupError); err != nil {
+			return err
+		}
+	}
+	if c.KeepEntrypoint {
+		if err := c.Method.setKeepEntrypoint(true); err != nil {
+			return err
+		}
+	}
+	if c.StopTimeout != 0 {
+		if err := c.Method.setStopTimeout(c.StopTimeout); err != nil {
+			return err
+		}
+	}
+	if len(c.Secrets) > 0 {
+		if err := c.Method.setSecrets(c.Secrets); err != nil {
+			return err
+		}
+	}
+	if c.DetachKeys != "" {
+		if err := c.Method.setDetachKeys(c.DetachKeys); err != nil {
+			return err
+		}
+	}
+	if c.TTYWidth != 0 || c.TTYHeight != 0 {
+		if err := c.Method.setTerminalSize(c.TTYWidth, c.TTYHeight); err != nil {
+			return err
+		}
+	}
+	if c.IdleTimeout != 0 {
+		if err := c.Method.setIdleTimeout(c.IdleTimeout); err != nil {
+			return err
+		}
+	}
+	if c.StdinEOFTimeout != 0 {
+		if err := c.Method.setStdinEOFTimeout(c.StdinEOFTimeout); err != nil {
+			return err
+		}
+	}
+	if c.AttachTimeout != 0 {
+		if err := c.Method.setAttachTimeout(c.AttachTimeout); err != nil {
+			return err
+		}
+	}
 
 	if c.started {
 		return errors.New("dexec: already started")
@@ -86,6 +434,10 @@ func (c *Cmd) Start() error {
 	c.started = true
 
 	if c.Stdin == nil {
+		// nothing to stream, so do not attach standard input at all
+		if err := c.Method.setNoStdin(true); err != nil {
+			return err
+		}
 		c.Stdin = empty
 	}
 	if c.Stdout == nil {
@@ -95,36 +447,326 @@ func (c *Cmd) Start() error {
 		c.Stderr = ioutil.Discard
 	}
 
+	stdouts := append([]io.Writer{c.Stdout}, c.stdoutTees...)
+	stderrs := append([]io.Writer{c.Stderr}, c.stderrTees...)
+	if c.StderrTail > 0 {
+		c.stderrTail = newTailBuffer(c.StderrTail)
+		stderrs = append(stderrs, c.stderrTail)
+	}
+	if c.OnOutput != nil {
+		lo, le := newLineWriters(c.OnOutput)
+		c.lines = []*lineWriter{lo, le}
+		stdouts, stderrs = append(stdouts, lo), append(stderrs, le)
+	}
+	stdout, stderr := c.output("Stdout", stdouts), c.output("Stderr", stderrs)
+
 	cmd := append([]string{c.Path}, c.Args...)
+	if c.Umask != nil {
+		cmd = umaskCommand(*c.Umask, cmd)
+	}
 	if err := c.Method.create(c.docker, cmd); err != nil {
 		return err
 	}
-	if err := c.Method.run(c.docker, c.Stdin, c.Stdout, c.Stderr); err != nil {
+	if err := c.Method.run(c.docker, c.Stdin, stdout, stderr); err != nil {
 		return err
 	}
 	return nil
 }
 
+// umaskCommand returns cmd wrapped to run with the file mode creation mask set
+// to mask by DefaultShell.
+func umaskCommand(mask os.FileMode, cmd []string) []string {
+	script := fmt.Sprintf(`umask %04o && exec "$@"`, uint32(mask))
+	return append([]string{DefaultShell, "-c", script, DefaultShell}, cmd...)
+}
+
+// argsTooLong reports whether args and env are too long to be passed to a
+// new process. Strings take their length plus a NUL byte and a pointer.
+func argsTooLong(args, env []string) bool {
+	n := 0
+	for _, l := range [][]string{args, env} {
+		for _, s := range l {
+			if len(s)+1 > maxArgLen {
+				return true
+			}
+			n += len(s) + 1 + 8
+		}
+	}
+	return n > maxArgsLen
+}
+
+// inheritedEnv returns the variables named in InheritEnv that are set in the
+// current process.
+func (c *Cmd) inheritedEnv() []string {
+	var env []string
+	for _, k := range c.InheritEnv {
+		if v, ok := os.LookupEnv(k); ok {
+			env = append(env, k+"="+v)
+		}
+	}
+	return env
+}
+
+// mergeEnv returns the variables of inherited not set in env, followed by env.
+func mergeEnv(env, inherited []string) []string {
+	set := make(map[string]bool, len(env))
+	for _, kv := range env {
+		set[strings.SplitN(kv, "=", 2)[0]] = true
+	}
+	var merged []string
+	for _, kv := range inherited {
+		if !set[strings.SplitN(kv, "=", 2)[0]] {
+			merged = append(merged, kv)
+		}
+	}
+	return append(merged, env...)
+}
+
 // Wait waits for the command to exit. It must have been started by Start.
 //
 // If the container exits with a non-zero exit code, the error is of type
-// *ExitError. Other error types may be returned for I/O problems and such.
+// *ExitError. Other error types may be returned for I/O problems and such,
+// including failures writing to Stdout or Stderr.
 //
 // Different than os/exec.Wait, this method will not release any resources
-// associated with Cmd (such as file handles).
+// associated with Cmd (such as file handles), except the ones created by
+// SetStdinFile, SetStdoutCloser, SetStderrCloser, StdoutPipe and
+// StderrPipe. These are closed in reverse order of creation and if the
+// command succeeded, errors closing them are returned.
 func (c *Cmd) Wait() error {
-	defer closeFds(c.closeAfterWait)
+	ec, err := c.WaitStatus()
+	if ec > 0 {
+		ee := newExitError(c.Path, c.Args, c.Method.containerID(), ec)
+		if c.stderrTail != nil {
+			ee.Stderr = c.stderrTail.Bytes()
+		}
+		return ee
+	}
+	return err
+}
+
+// WaitStatus waits for the command to exit like Wait, but returns the exit
+// code of the command instead of an *ExitError, so that the error is non-nil
+// only for problems other than the command failing.
+//
+// If the exit code of the command cannot be determined, it is -1. The error
+// can be non-nil along with a valid exit code, such as for failures writing to
+// Stdout or Stderr.
+func (c *Cmd) WaitStatus() (exitCode int, err error) {
+	defer func() {
+		if cerr := closeFds(c.closeAfterWait); err == nil {
+			err = cerr
+		}
+	}()
 	if !c.started {
-		return errors.New("dexec: not started")
+		return -1, errors.New("dexec: not started")
 	}
 	ec, err := c.Method.wait(c.docker)
+	for _, l := range c.lines {
+		l.flush()
+	}
 	if err != nil {
-		return err
+		return -1, err
 	}
-	if ec != 0 {
-		return &ExitError{ExitCode: ec}
+	for _, o := range c.outputs {
+		if o.err != nil {
+			return ec, fmt.Errorf("dexec: error writing to %s: %v", o.stream, o.err)
+		}
 	}
-	return nil
+	return ec, nil
+}
+
+// Detach stops streaming from the command and makes a blocked or subsequent
+// Wait return ErrDetached, without stopping or removing the container. The
+// container keeps running and its standard input is closed; Wait still closes
+// the pipes created by StdoutPipe and StderrPipe, so readers see EOF. It must
+// have been started by Start.
+//
+// The caller becomes responsible for the container, which can be identified
+// with Inspect before Detach and removed with Cleanup.
+func (c *Cmd) Detach() error {
+	if !c.started {
+		return errors.New("dexec: not started")
+	}
+	return c.Method.detach(c.docker)
+}
+
+// Cleanup removes the container created for the command, if it still exists.
+// It is needed only if KeepContainer is set or Detach is called, as Wait
+// removes the container otherwise. Calling Cleanup more than once is safe.
+func (c *Cmd) Cleanup() error {
+	_, err := c.CleanupWithOutcome()
+	return err
+}
+
+// CleanupOutcome is the outcome of removing the container of a command.
+type CleanupOutcome int
+
+const (
+	// CleanupFailed means the container could not be removed, and the error
+	// says why.
+	CleanupFailed CleanupOutcome = iota
+
+	// CleanupRemoved means the container was removed by the call.
+	CleanupRemoved
+
+	// CleanupAlreadyGone means there was no container to remove, as it was
+	// removed earlier by Wait or Cleanup, or by someone else.
+	CleanupAlreadyGone
+)
+
+func (o CleanupOutcome) String() string {
+	switch o {
+	case CleanupRemoved:
+		return "Removed"
+	case CleanupAlreadyGone:
+		return "AlreadyGone"
+	}
+	return "Failed"
+}
+
+// CleanupWithOutcome is like Cleanup, but also reports whether the call
+// removed the container or there was nothing left to remove, such as for
+// accounting of reclaimed resources. The outcome concerns the container only;
+// an error removing the files of Secrets is returned along with the outcome
+// of removing the container.
+func (c *Cmd) CleanupWithOutcome() (CleanupOutcome, error) {
+	if !c.started {
+		return CleanupFailed, errors.New("dexec: not started")
+	}
+	return c.Method.cleanup(c.docker)
+}
+
+// Inspect returns information about the container executing the command. It
+// must have been started by Start and the container must not be removed yet.
+func (c *Cmd) Inspect() (ContainerInfo, error) {
+	if !c.started {
+		return ContainerInfo{}, errors.New("dexec: not started")
+	}
+	return c.Method.inspect(c.docker)
+}
+
+// pollInterval is how often WaitHealthy and WaitForState inspect the
+// container.
+const pollInterval = 250 * time.Millisecond
+
+// WaitHealthy waits until the container executing the command reports healthy,
+// which is useful for commands that run a service. It must have been started
+// by Start.
+//
+// The health check is configured on the container image or through
+// Config.Healthcheck of the options given to ByCreatingContainer. An error is
+// returned if the container has no health check, becomes unhealthy, stops
+// running or is not healthy within the timeout.
+func (c *Cmd) WaitHealthy(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		info, err := c.Inspect()
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.Health == "healthy":
+			return nil
+		case info.Health == "":
+			return errors.New("dexec: container has no health check")
+		case info.Health == "unhealthy":
+			return errors.New("dexec: container is unhealthy")
+		case info.State != "running":
+			return fmt.Errorf("dexec: container is %s", info.State)
+		case time.Now().After(deadline):
+			return errors.New("dexec: timed out waiting for container to become healthy")
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// containerStates are the states reported in ContainerInfo.State.
+var containerStates = map[string]bool{
+	"created": true, "running": true, "paused": true,
+	"restarting": true, "exited": true,
+}
+
+// WaitForState waits until the container executing the command is in state,
+// one of the states reported in ContainerInfo.State, such as "running" to
+// attach a debugger to the command. It must have been started by Start.
+//
+// An error is returned if the container exits or is removed before reaching
+// state, or does not reach it within the timeout.
+func (c *Cmd) WaitForState(state string, timeout time.Duration) error {
+	if !containerStates[state] {
+		return fmt.Errorf("dexec: unknown container state %q", state)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		info, err := c.Inspect()
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.State == state:
+			return nil
+		case info.State == "exited":
+			return errors.New("dexec: container exited")
+		case time.Now().After(deadline):
+			return fmt.Errorf("dexec: timed out waiting for container to be %s", state)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// FinalState returns the final state of the container that executed the
+// command. It is captured by Wait before the container is removed, so it is
+// available only after Wait observes the command exit.
+func (c *Cmd) FinalState() (State, error) {
+	if !c.started {
+		return State{}, errors.New("dexec: not started")
+	}
+	return c.Method.finalState()
+}
+
+// Signal sends sig to the command. Like Kill, it is safe to call from another
+// goroutine while the command runs, such as by a supervisor while Run blocks.
+// Signal returns an error if the command is not running, such as if it has
+// not been started yet or has already exited.
+func (c *Cmd) Signal(sig syscall.Signal) error {
+	if c.Method == nil {
+		return ErrNilMethod
+	}
+	return c.Method.signal(c.docker, sig)
+}
+
+// Kill kills the command with SIGKILL. It is safe to call from another
+// goroutine while the command runs, including while Run, Output or a similar
+// method blocks; Wait then returns ErrKilled once the container exits and is
+// removed. Kill returns an error if the command is not running, such as if it
+// has not been started yet or has already exited.
+func (c *Cmd) Kill() error {
+	if c.Method == nil {
+		return ErrNilMethod
+	}
+	return c.Method.kill(c.docker)
+}
+
+// Resize changes the size of the terminal of the command to cols columns and
+// rows rows, such as when the window of the client changes. It must have been
+// started by Start with Config.Tty set in the options of Method, and still be
+// running.
+func (c *Cmd) Resize(cols, rows uint16) error {
+	if !c.started {
+		return errors.New("dexec: not started")
+	}
+	return c.Method.resize(c.docker, cols, rows)
+}
+
+// Changes returns the changes the command made to the container filesystem.
+// It must have been started by Start and the container must not be removed,
+// so to get the changes after the command exits, set KeepContainer.
+func (c *Cmd) Changes() ([]FileChange, error) {
+	if !c.started {
+		return nil, errors.New("dexec: not started")
+	}
+	return c.Method.changes(c.docker)
 }
 
 // Run starts the specified command and waits for it to complete.
@@ -147,17 +789,26 @@ func (c *Cmd) Run() error {
 // Docker API does not have strong guarantees over ordering of messages. For instance:
 //     >&1 echo out; >&2 echo err
 // may result in "out\nerr\n" as well as "err\nout\n" from this method.
+//
+// Both streams are received over a single multiplexed connection and written
+// in the order they arrive, however Docker engine reads the standard output
+// and error of the command independently, which is where the ordering is
+// lost. Setting Config.Tty in the options of Method is the only option that
+// keeps the order, as the command then writes both streams to one terminal,
+// which Docker sends as a single stream with "\r\n" line endings. Otherwise,
+// redirect the streams in the command, e.g. by running it with
+// "sh -c '... 2>&1'".
 func (c *Cmd) CombinedOutput() ([]byte, error) {
-	if c.Stdout != nil {
-		return nil, errors.New("dexec: Stdout already set")
+	if err := c.configureStream("Stdout", "CombinedOutput", streamCapture); err != nil {
+		return nil, err
 	}
-	if c.Stderr != nil {
-		return nil, errors.New("dexec: Stderr already set")
+	if err := c.configureStream("Stderr", "CombinedOutput", streamCapture); err != nil {
+		return nil, err
 	}
-	var b bytes.Buffer
-	c.Stdout, c.Stderr = &b, &b
+	b := &captureBuffer{max: c.MaxOutputBytes}
+	c.Stdout, c.Stderr = b, b
 	err := c.Run()
-	return b.Bytes(), err
+	return b.Bytes(), truncate(err, b)
 }
 
 // Output runs the command and returns its standard output.
@@ -165,17 +816,21 @@ func (c *Cmd) CombinedOutput() ([]byte, error) {
 // If the container exits with a non-zero exit code, the error is of type
 // *ExitError. Other error types may be returned for I/O problems and such.
 //
-// If c.Stderr was nil, Output populates ExitError.Stderr.
+// If c.Stderr was nil, Output populates ExitError.Stderr. Standard error is
+// discarded if the command succeeds; use SeparatedOutput to get it regardless
+// of the exit code.
 func (c *Cmd) Output() ([]byte, error) {
-	if c.Stdout != nil {
-		return nil, errors.New("dexec: Stdout already set")
+	if err := c.configureStream("Stdout", "Output", streamCapture); err != nil {
+		return nil, err
 	}
-	var stdout, stderr bytes.Buffer
-	c.Stdout = &stdout
+	stdout := &captureBuffer{max: c.MaxOutputBytes}
+	stderr := &captureBuffer{max: c.MaxOutputBytes}
+	c.Stdout = stdout
 
 	captureErr := c.Stderr == nil
 	if captureErr {
-		c.Stderr = &stderr
+		c.Stderr = stderr
+		c.stderrMode = streamCapture
 	}
 	err := c.Run()
 	if err != nil && captureErr {
@@ -183,7 +838,75 @@ func (c *Cmd) Output() ([]byte, error) {
 			ee.Stderr = stderr.Bytes()
 		}
 	}
-	return stdout.Bytes(), err
+	return stdout.Bytes(), truncate(err, stdout)
+}
+
+// SeparatedOutput runs the command and returns its standard output and
+// standard error. Different than Output, standard error is returned even if
+// the command succeeds, such as for logging warnings of tools that exit with
+// zero. Stdout and Stderr must not be set.
+//
+// If the container exits with a non-zero exit code, the error is of type
+// *ExitError and its Stderr field holds the same bytes as stderr, taking
+// precedence over Cmd.StderrTail. To get the exit code without an error, use
+// ExecuteAndWait instead.
+func (c *Cmd) SeparatedOutput() (stdout, stderr []byte, err error) {
+	if err := c.configureStream("Stdout", "SeparatedOutput", streamCapture); err != nil {
+		return nil, nil, err
+	}
+	if err := c.configureStream("Stderr", "SeparatedOutput", streamCapture); err != nil {
+		return nil, nil, err
+	}
+	outb := &captureBuffer{max: c.MaxOutputBytes}
+	errb := &captureBuffer{max: c.MaxOutputBytes}
+	c.Stdout, c.Stderr = outb, errb
+
+	err = c.Run()
+	if ee, ok := err.(*ExitError); ok {
+		ee.Stderr = errb.Bytes()
+	}
+	return outb.Bytes(), errb.Bytes(), truncate(err, outb, errb)
+}
+
+// CombinedOutputReader starts the command and returns a reader of its combined
+// standard output and standard error, streamed as the output arrives, with
+// the same ordering caveats as CombinedOutput: only Config.Tty, set in the
+// options of Method, keeps the order of the two streams. Stdout and Stderr
+// must not be set.
+//
+// The caller must call Wait after reading the output to EOF or closing the
+// reader. Closing the reader before the command exits kills the command, and
+// Wait then returns ErrKilled. Commands of a Session cannot be killed, so for
+// them Close returns an error, and the command keeps running until it exits
+// by itself.
+func (c *Cmd) CombinedOutputReader() (io.ReadCloser, error) {
+	if err := c.configureStream("Stdout", "CombinedOutputReader", streamPipe); err != nil {
+		return nil, err
+	}
+	if err := c.configureStream("Stderr", "CombinedOutputReader", streamPipe); err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	c.Stdout, c.Stderr = pw, pw
+	c.closeAfterWait = append(c.closeAfterWait, pw)
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	return &outputReader{PipeReader: pr, c: c}, nil
+}
+
+// outputReader is a pipe reader that kills the command when closed.
+type outputReader struct {
+	*io.PipeReader
+	c *Cmd
+}
+
+func (r *outputReader) Close() error {
+	r.PipeReader.Close()
+	if err := r.c.Kill(); err != errNotRunning {
+		return err // nil if killed
+	}
+	return nil // already exited
 }
 
 // StdinPipe returns a pipe that will be connected to the command's standard input
@@ -191,21 +914,88 @@ func (c *Cmd) Output() ([]byte, error) {
 //
 // Different than os/exec.StdinPipe, returned io.WriteCloser should be closed by user.
 func (c *Cmd) StdinPipe() (io.WriteCloser, error) {
-	if c.Stdin != nil {
-		return nil, errors.New("dexec: Stdin already set")
+	if err := c.configureStream("Stdin", "StdinPipe", streamPipe); err != nil {
+		return nil, err
 	}
 	pr, pw := io.Pipe()
 	c.Stdin = pr
 	return pw, nil
 }
 
+// SetStdinFile opens the named file and sets it as the command's standard
+// input.
+//
+// Different than setting Stdin to an *os.File, Wait will close the file after
+// seeing the command exit or in error conditions.
+func (c *Cmd) SetStdinFile(name string) error {
+	if err := c.configureStream("Stdin", "SetStdinFile", streamFile); err != nil {
+		return err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	c.Stdin = f
+	c.closeAfterWait = append(c.closeAfterWait, f)
+	return nil
+}
+
+// SetStdoutCloser sets w as the command's standard output and makes Wait
+// close it once the command exits, such as a writer that uploads the output
+// to storage and completes the upload on Close. Wait reports an error from
+// Close if the command otherwise succeeded. If Start fails, w is not closed.
+func (c *Cmd) SetStdoutCloser(w io.WriteCloser) error {
+	if err := c.configureStream("Stdout", "SetStdoutCloser", streamCloser); err != nil {
+		return err
+	}
+	c.Stdout = w
+	c.closeAfterWait = append(c.closeAfterWait, callerCloser{w})
+	return nil
+}
+
+// SetStderrCloser is like SetStdoutCloser, but for standard error.
+func (c *Cmd) SetStderrCloser(w io.WriteCloser) error {
+	if err := c.configureStream("Stderr", "SetStderrCloser", streamCloser); err != nil {
+		return err
+	}
+	c.Stderr = w
+	c.closeAfterWait = append(c.closeAfterWait, callerCloser{w})
+	return nil
+}
+
+// AddStdoutWriter registers w to receive a copy of the command's standard
+// output when the command starts, in addition to Stdout. It can be used along
+// with Output, CombinedOutput and StdoutPipe, which set Stdout.
+//
+// A failing writer does not affect the others; Wait reports its error.
+func (c *Cmd) AddStdoutWriter(w io.Writer) error {
+	if c.started {
+		return errors.New("dexec: already started")
+	}
+	c.stdoutTees = append(c.stdoutTees, w)
+	return nil
+}
+
+// AddStderrWriter registers w to receive a copy of the command's standard
+// error when the command starts, in addition to Stderr. It can be used along
+// with CombinedOutput and StderrPipe, which set Stderr.
+//
+// A failing writer does not affect the others; Wait reports its error.
+func (c *Cmd) AddStderrWriter(w io.Writer) error {
+	if c.started {
+		return errors.New("dexec: already started")
+	}
+	c.stderrTees = append(c.stderrTees, w)
+	return nil
+}
+
 // StdoutPipe returns a pipe that will be connected to the command's standard output when
 // the command starts.
 //
 // Wait will close the pipe after seeing the command exit or in error conditions.
 func (c *Cmd) StdoutPipe() (io.ReadCloser, error) {
-	if c.Stdout != nil {
-		return nil, errors.New("dexec: Stdout already set")
+	if err := c.configureStream("Stdout", "StdoutPipe", streamPipe); err != nil {
+		return nil, err
 	}
 	pr, pw := io.Pipe()
 	c.Stdout = pw
@@ -218,8 +1008,8 @@ func (c *Cmd) StdoutPipe() (io.ReadCloser, error) {
 //
 // Wait will close the pipe after seeing the command exit or in error conditions.
 func (c *Cmd) StderrPipe() (io.ReadCloser, error) {
-	if c.Stderr != nil {
-		return nil, errors.New("dexec: Stderr already set")
+	if err := c.configureStream("Stderr", "StderrPipe", streamPipe); err != nil {
+		return nil, err
 	}
 	pr, pw := io.Pipe()
 	c.Stderr = pw
@@ -227,10 +1017,68 @@ func (c *Cmd) StderrPipe() (io.ReadCloser, error) {
 	return pr, nil
 }
 
-func closeFds(l []io.Closer) {
-	for _, fd := range l {
-		fd.Close()
+// output combines the writers of a stream such that a failing writer does not
+// stop the others from receiving data.
+func (c *Cmd) output(stream string, ws []io.Writer) io.Writer {
+	l := make([]io.Writer, len(ws))
+	for i, w := range ws {
+		d := &discardOnError{w: w, stream: stream}
+		c.outputs = append(c.outputs, d)
+		l[i] = d
+	}
+	if len(l) == 1 {
+		return l[0]
+	}
+	return io.MultiWriter(l...)
+}
+
+// callerCloser marks a handle of the caller in closeAfterWait, which Start
+// does not close if it fails.
+type callerCloser struct {
+	io.Closer
+}
+
+// closeFds closes the handles in reverse order of registration and returns
+// the errors encountered, if any.
+func closeFds(l []io.Closer) error {
+	var errs closeErrors
+	for i := len(l) - 1; i >= 0; i-- {
+		if err := l[i].Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// closeErrors reports failures closing handles after Wait.
+type closeErrors []error
+
+func (e closeErrors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return "dexec: error closing handles: " + strings.Join(s, "; ")
+}
+
+// discardOnError wraps a writer so that once a write to it fails, subsequent
+// data is discarded rather than failing the stream from the container.
+type discardOnError struct {
+	w      io.Writer
+	stream string // "Stdout" or "Stderr", for errors
+	err    error  // first write error
+}
+
+func (d *discardOnError) Write(b []byte) (int, error) {
+	if d.err == nil {
+		if _, err := d.w.Write(b); err != nil {
+			d.err = err
+		}
 	}
+	return len(b), nil
 }
 
 type emptyReader struct{}
@@ -1,16 +1,22 @@
 package dexec_test
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/ahmetb/go-dexec"
 	"github.com/fsouza/go-dockerclient"
@@ -87,6 +93,20 @@ func (s *CmdTestSuite) TestNewCommand(c *C) {
 	c.Assert(cmd.Args, DeepEquals, []string{"arg1", "arg2"})
 }
 
+func (s *CmdTestSuite) TestNewCommandShell(c *C) {
+	cc := baseContainer(c)
+	cmd := s.d.CommandShell(cc, "echo foo | wc -c")
+	c.Assert(cmd.Method, Equals, cc)
+	c.Assert(cmd.Path, Equals, "/bin/sh")
+	c.Assert(cmd.Args, DeepEquals, []string{"-c", "echo foo | wc -c"})
+}
+
+func (s *CmdTestSuite) TestRunCommandShell(c *C) {
+	b, err := s.d.CommandShell(baseContainer(c), "echo foo | tr o 0").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "f00\n")
+}
+
 func (s *CmdTestSuite) TestJustStart(c *C) {
 	cmd := s.d.Command(baseContainer(c), "echo", "arg1", "arg2")
 
@@ -102,6 +122,87 @@ func (s *CmdTestSuite) TestConfigNotSet(c *C) {
 	c.Assert(err, ErrorMatches, "dexec: Config is nil")
 }
 
+func (s *CmdTestSuite) TestNilClient(c *C) {
+	cmd := dexec.Docker{}.Command(baseContainer(c), "echo")
+	c.Assert(cmd.Start(), Equals, dexec.ErrNilClient)
+}
+
+func (s *CmdTestSuite) TestNilMethod(c *C) {
+	cmd := s.d.Command(nil, "echo")
+	c.Assert(cmd.Start(), Equals, dexec.ErrNilMethod)
+}
+
+func (s *CmdTestSuite) TestInvalidOptions(c *C) {
+	for _, tt := range []struct {
+		opts docker.CreateContainerOptions
+		err  string
+	}{
+		{docker.CreateContainerOptions{Config: &docker.Config{}}, "dexec: Config.Image is empty"},
+		{docker.CreateContainerOptions{Config: &docker.Config{Image: "busybox", Hostname: "-foo"}}, `dexec: invalid hostname "-foo"`},
+		{docker.CreateContainerOptions{Config: &docker.Config{Image: "busybox", Hostname: "foo..bar"}}, `dexec: invalid hostname "foo..bar"`},
+		{docker.CreateContainerOptions{Config: &docker.Config{Image: "busybox", Hostname: "foo_bar"}}, `dexec: invalid hostname "foo_bar"`},
+		{docker.CreateContainerOptions{Config: &docker.Config{Image: "busybox", StopSignal: "SIGFOO"}}, `dexec: invalid signal "SIGFOO"`},
+		{docker.CreateContainerOptions{Config: &docker.Config{Image: "busybox", StopSignal: "0"}}, `dexec: invalid signal "0"`},
+		{docker.CreateContainerOptions{Config: &docker.Config{Image: "busybox", StopSignal: "SIGRTMIN+16"}}, `dexec: invalid signal "SIGRTMIN\+16"`},
+		{docker.CreateContainerOptions{Config: &docker.Config{Image: "busybox"},
+			HostConfig: &docker.HostConfig{Binds: []string{"/tmp"}}}, `dexec: invalid bind "/tmp" .*`},
+		{docker.CreateContainerOptions{Config: &docker.Config{Image: "busybox"},
+			HostConfig: &docker.HostConfig{Binds: []string{":/tmp"}}}, `dexec: invalid bind ":/tmp" .*`},
+		{docker.CreateContainerOptions{Config: &docker.Config{Image: "busybox"},
+			HostConfig: &docker.HostConfig{Binds: []string{"/tmp:tmp"}}}, `dexec: invalid bind "/tmp:tmp" .*`},
+		{docker.CreateContainerOptions{Config: &docker.Config{Image: "busybox"},
+			HostConfig: &docker.HostConfig{Binds: []string{"/tmp:/tmp:ro:z"}}}, `dexec: invalid bind "/tmp:/tmp:ro:z" .*`},
+		{docker.CreateContainerOptions{Config: &docker.Config{Image: "busybox"},
+			HostConfig: &docker.HostConfig{Binds: []string{"/tmp:/tmp:ro,rsalve"}}}, `dexec: invalid bind "/tmp:/tmp:ro,rsalve": unknown option "rsalve"`},
+		{docker.CreateContainerOptions{Config: &docker.Config{Image: "busybox"},
+			HostConfig: &docker.HostConfig{Binds: []string{"/tmp:/tmp:"}}}, `dexec: invalid bind "/tmp:/tmp:": unknown option ""`},
+		{docker.CreateContainerOptions{Config: &docker.Config{Hostname: "-foo"}},
+			`dexec: 2 invalid options: Config.Image is empty; invalid hostname "-foo"`},
+	} {
+		_, err := dexec.ByCreatingContainer(tt.opts)
+		c.Assert(err, ErrorMatches, tt.err)
+	}
+}
+
+func (s *CmdTestSuite) TestBindOptions(c *C) {
+	opts := baseOpts()
+	opts.HostConfig = &docker.HostConfig{Binds: []string{"/tmp:/mnt:ro,rslave"}}
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+
+	err = s.d.Command(e, "touch", "/mnt/foo").Run()
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+}
+
+func (s *CmdTestSuite) TestStopSignal(c *C) {
+	for _, sig := range []string{"SIGQUIT", "QUIT", "sigquit", "3", "SIGRTMIN+3", "RTMAX", "SIGRTMAX-14"} {
+		opts := baseOpts()
+		opts.Config.StopSignal = sig
+		_, err := dexec.ByCreatingContainer(opts)
+		c.Assert(err, IsNil, Commentf("%q", sig))
+	}
+}
+
+func (s *CmdTestSuite) TestEmptyPath(c *C) {
+	err := s.d.Command(baseContainer(c), "").Start()
+	c.Assert(err, ErrorMatches, "dexec: Path is empty")
+}
+
+func (s *CmdTestSuite) TestArgListTooLong(c *C) {
+	err := s.d.Command(baseContainer(c), "echo", strings.Repeat("x", 1<<20)).Start()
+	c.Assert(err, Equals, dexec.ErrArgListTooLong)
+}
+
+func (s *CmdTestSuite) TestArgListTooLongConfigEnv(c *C) {
+	opts := baseOpts()
+	opts.Config.Env = []string{"A=" + strings.Repeat("x", 1<<20)}
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+
+	err = s.d.Command(e, "true").Start()
+	c.Assert(err, Equals, dexec.ErrArgListTooLong)
+}
+
 func (s *CmdTestSuite) TestDoubleStart(c *C) {
 	cmd := s.d.Command(baseContainer(c), "echo")
 
@@ -131,6 +232,13 @@ func (s *CmdTestSuite) TestDirAlreadySet(c *C) {
 	c.Assert(err, ErrorMatches, "dexec: Config.WorkingDir already set")
 }
 
+func (s *CmdTestSuite) TestRelativeDir(c *C) {
+	cmd := s.d.Command(baseContainer(c), "pwd")
+	cmd.Dir = "tmp"
+	err := cmd.Start()
+	c.Assert(err, ErrorMatches, `dexec: Dir must be an absolute path: "tmp"`)
+}
+
 func (s *CmdTestSuite) TestEnvAlreadySet(c *C) {
 	opts := baseOpts()
 	opts.Config.Env = []string{"A=B"}
@@ -154,6 +262,19 @@ func (s *CmdTestSuite) TestEntrypointAlreadySet(c *C) {
 	c.Assert(err, ErrorMatches, "dexec: Config.Entrypoint already set")
 }
 
+func (s *CmdTestSuite) TestKeepEntrypoint(c *C) {
+	opts := baseOpts()
+	opts.Config.Entrypoint = []string{"echo", "entrypoint"}
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+
+	cmd := s.d.Command(e, "arg1", "arg2")
+	cmd.KeepEntrypoint = true
+	b, err := cmd.Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "entrypoint arg1 arg2\n")
+}
+
 func (s *CmdTestSuite) TestCmdAlreadySet(c *C) {
 	opts := baseOpts()
 	opts.Config.Cmd = []string{"date", "-u"}
@@ -209,10 +330,13 @@ func (s *CmdTestSuite) TestNonZeroExitCodeReturnedInError(c *C) {
 	err := cmd.Run()
 	c.Assert(err, NotNil)
 	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
-	c.Assert(err, ErrorMatches, "dexec: exit status: 3")
+	c.Assert(err, ErrorMatches, `dexec: "sh -c >&2 echo error; exit 3" in container [0-9a-f]{12}: exit status: 3`)
 
 	ecErr := err.(*dexec.ExitError)
 	c.Assert(ecErr.ExitCode, Equals, 3)
+	c.Assert(ecErr.Path, Equals, "sh")
+	c.Assert(ecErr.Args, DeepEquals, []string{"-c", ">&2 echo error; exit 3"})
+	c.Assert(ecErr.ContainerID, Matches, "[0-9a-f]{64}")
 	c.Assert(ecErr.Stderr, IsNil) // Run() shouldn't set ExitError.Stderr
 }
 
@@ -242,6 +366,20 @@ jumped`
 	c.Assert(string(b.Bytes()), Equals, in)
 }
 
+func (s *CmdTestSuite) TestRunWithoutStdin(c *C) {
+	opts := baseOpts()
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "sh", "-c", "cat; sleep 1")
+	c.Assert(cmd.Start(), IsNil)
+
+	ct, err := s.d.InspectContainer(opts.Name)
+	c.Assert(err, IsNil)
+	c.Assert(ct.Config.AttachStdin, Equals, false)
+	c.Assert(ct.Config.OpenStdin, Equals, false)
+	c.Assert(cmd.Wait(), IsNil)
+}
+
 func (s *CmdTestSuite) TestRunWithDir(c *C) {
 	cmd := s.d.Command(baseContainer(c), "pwd")
 	cmd.Dir = "/tmp"
@@ -253,6 +391,17 @@ func (s *CmdTestSuite) TestRunWithDir(c *C) {
 	c.Assert(string(b.Bytes()), Equals, cmd.Dir+"\n")
 }
 
+func (s *CmdTestSuite) TestRunWithHostname(c *C) {
+	opts := baseOpts()
+	opts.Config.Hostname = "worker-1.example"
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+
+	b, err := s.d.Command(e, "hostname").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "worker-1.example\n")
+}
+
 func (s *CmdTestSuite) TestRunWithEnv(c *C) {
 	cmd := s.d.Command(baseContainer(c), "env")
 	cmd.Env = []string{"A=B", "C=D"}
@@ -268,6 +417,48 @@ func (s *CmdTestSuite) TestRunWithEnv(c *C) {
 	c.Assert(strings.Contains(out, "C=D\n"), Equals, true)
 }
 
+func (s *CmdTestSuite) TestRunWithInheritEnv(c *C) {
+	os.Setenv("DEXEC_TEST_A", "host-a")
+	os.Setenv("DEXEC_TEST_B", "host-b")
+	os.Unsetenv("DEXEC_TEST_C")
+	defer os.Unsetenv("DEXEC_TEST_A")
+	defer os.Unsetenv("DEXEC_TEST_B")
+
+	cmd := s.d.Command(baseContainer(c), "env")
+	cmd.Env = []string{"DEXEC_TEST_B=cmd-b"}
+	cmd.InheritEnv = []string{"DEXEC_TEST_A", "DEXEC_TEST_B", "DEXEC_TEST_C"}
+	b, err := cmd.Output()
+	c.Assert(err, IsNil)
+
+	out := string(b)
+	c.Assert(strings.Contains(out, "DEXEC_TEST_A=host-a\n"), Equals, true)
+	c.Assert(strings.Contains(out, "DEXEC_TEST_B=cmd-b\n"), Equals, true)
+	c.Assert(strings.Contains(out, "DEXEC_TEST_B=host-b"), Equals, false)
+	c.Assert(strings.Contains(out, "DEXEC_TEST_C="), Equals, false)
+}
+
+func (s *CmdTestSuite) TestRunWithInheritEnvAndConfigEnv(c *C) {
+	os.Setenv("DEXEC_TEST_A", "host-a")
+	os.Setenv("DEXEC_TEST_B", "host-b")
+	defer os.Unsetenv("DEXEC_TEST_A")
+	defer os.Unsetenv("DEXEC_TEST_B")
+
+	opts := baseOpts()
+	opts.Config.Env = []string{"DEXEC_TEST_B=config-b"}
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+
+	cmd := s.d.Command(e, "env")
+	cmd.InheritEnv = []string{"DEXEC_TEST_A", "DEXEC_TEST_B"}
+	b, err := cmd.Output()
+	c.Assert(err, IsNil)
+
+	out := string(b)
+	c.Assert(strings.Contains(out, "DEXEC_TEST_A=host-a\n"), Equals, true)
+	c.Assert(strings.Contains(out, "DEXEC_TEST_B=config-b\n"), Equals, true)
+	c.Assert(strings.Contains(out, "DEXEC_TEST_B=host-b"), Equals, false)
+}
+
 func (s *CmdTestSuite) TestRunStdoutStderrDontMix(c *C) {
 	cmd := s.d.Command(baseContainer(c), "sh", "-c", "echo out; >&2 echo err;")
 	var outS, errS bytes.Buffer
@@ -283,7 +474,7 @@ func (s *CmdTestSuite) TestCombinedOutputStdoutAlreadySet(c *C) {
 	cmd := s.d.Command(baseContainer(c), "env")
 	cmd.Stdout = &b
 	_, err := cmd.CombinedOutput()
-	c.Assert(err, ErrorMatches, "dexec: Stdout already set")
+	c.Assert(err, ErrorMatches, "dexec: Stdout already configured as a writer; cannot use CombinedOutput")
 }
 
 func (s *CmdTestSuite) TestCombinedOutputStderrAlreadySet(c *C) {
@@ -291,7 +482,7 @@ func (s *CmdTestSuite) TestCombinedOutputStderrAlreadySet(c *C) {
 	cmd := s.d.Command(baseContainer(c), "env")
 	cmd.Stderr = &b
 	_, err := cmd.CombinedOutput()
-	c.Assert(err, ErrorMatches, "dexec: Stderr already set")
+	c.Assert(err, ErrorMatches, "dexec: Stderr already configured as a writer; cannot use CombinedOutput")
 }
 
 func (s *CmdTestSuite) TestCombinedOutput(c *C) {
@@ -307,7 +498,7 @@ func (s *CmdTestSuite) TestOutputStdoutAlreadySet(c *C) {
 	cmd := s.d.Command(baseContainer(c), "env")
 	cmd.Stdout = &b
 	_, err := cmd.Output()
-	c.Assert(err, ErrorMatches, "dexec: Stdout already set")
+	c.Assert(err, ErrorMatches, "dexec: Stdout already configured as a writer; cannot use Output")
 }
 
 func (s *CmdTestSuite) TestOutputSuccessfulCommand(c *C) {
@@ -366,7 +557,7 @@ func (s *CmdTestSuite) TestStdinPipeAlreadySet(c *C) {
 	cmd := s.d.Command(baseContainer(c), "cat")
 	cmd.Stdin = bytes.NewReader([]byte{})
 	_, err := cmd.StdinPipe()
-	c.Assert(err, ErrorMatches, "dexec: Stdin already set")
+	c.Assert(err, ErrorMatches, "dexec: Stdin already configured as a reader; cannot use StdinPipe")
 }
 
 func (s *CmdTestSuite) TestStdinPipe(c *C) {
@@ -392,12 +583,65 @@ func (s *CmdTestSuite) TestStdinPipe(c *C) {
 	wg.Wait()
 }
 
+func (s *CmdTestSuite) TestSetStdinFileAlreadySet(c *C) {
+	cmd := s.d.Command(baseContainer(c), "cat")
+	cmd.Stdin = bytes.NewReader([]byte{})
+	c.Assert(cmd.SetStdinFile("/dev/null"), ErrorMatches, "dexec: Stdin already configured as a reader; cannot use SetStdinFile")
+}
+
+func (s *CmdTestSuite) TestSetStdinFileNotExist(c *C) {
+	cmd := s.d.Command(baseContainer(c), "cat")
+	c.Assert(cmd.SetStdinFile("/no/such/file"), NotNil)
+	c.Assert(cmd.Stdin, IsNil)
+}
+
+func (s *CmdTestSuite) TestSetStdinFile(c *C) {
+	f, err := ioutil.TempFile("", "dexec")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("Hello, world!")
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	cmd := s.d.Command(baseContainer(c), "cat")
+	c.Assert(cmd.SetStdinFile(f.Name()), IsNil)
+	b, err := cmd.Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "Hello, world!")
+
+	// file is closed by Wait
+	_, err = cmd.Stdin.(*os.File).Stat()
+	c.Assert(err, NotNil)
+}
+
+func (s *CmdTestSuite) TestSetStdinFileClosedOnStartError(c *C) {
+	opts := baseOpts()
+	opts.Config.Cmd = []string{"true"}
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "cat")
+	c.Assert(cmd.SetStdinFile("/dev/null"), IsNil)
+	c.Assert(cmd.Run(), ErrorMatches, "dexec: Config.Cmd already set")
+
+	// file is closed by Start
+	_, err = cmd.Stdin.(*os.File).Stat()
+	c.Assert(err, NotNil)
+}
+
 func (s *CmdTestSuite) TestStdoutPipeAlreadySet(c *C) {
 	var b bytes.Buffer
 	cmd := s.d.Command(baseContainer(c), "echo", "foo")
 	cmd.Stdout = &b
 	_, err := cmd.StdoutPipe()
-	c.Assert(err, ErrorMatches, "dexec: Stdout already set")
+	c.Assert(err, ErrorMatches, "dexec: Stdout already configured as a writer; cannot use StdoutPipe")
+}
+
+func (s *CmdTestSuite) TestOutputAfterStdoutPipe(c *C) {
+	cmd := s.d.Command(baseContainer(c), "echo", "foo")
+	_, err := cmd.StdoutPipe()
+	c.Assert(err, IsNil)
+	_, err = cmd.Output()
+	c.Assert(err, ErrorMatches, "dexec: Stdout already configured as a pipe; cannot use Output")
 }
 
 func (s *CmdTestSuite) TestStdoutPipe(c *C) {
@@ -445,7 +689,7 @@ func (s *CmdTestSuite) TestStderrPipeAlreadySet(c *C) {
 	cmd := s.d.Command(baseContainer(c), "echo", "foo")
 	cmd.Stderr = &b
 	_, err := cmd.StderrPipe()
-	c.Assert(err, ErrorMatches, "dexec: Stderr already set")
+	c.Assert(err, ErrorMatches, "dexec: Stderr already configured as a writer; cannot use StderrPipe")
 }
 
 func (s *CmdTestSuite) TestStderrPipe(c *C) {
@@ -512,3 +756,959 @@ func (s *CmdTestSuite) TestWaitDeletesContainerOnExitError(c *C) {
 	_, err = d.InspectContainer(name)
 	c.Assert(err, NotNil)
 }
+
+func (s *CmdTestSuite) TestKeepContainer(c *C) {
+	opts := baseOpts()
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+	name := opts.Name
+	cmd := s.d.Command(e, "date")
+	cmd.KeepContainer = true
+	c.Assert(cmd.Run(), IsNil)
+
+	d := testDocker(c)
+	_, err = d.InspectContainer(name)
+	c.Assert(err, IsNil)
+
+	c.Assert(cmd.Cleanup(), IsNil)
+	_, err = d.InspectContainer(name)
+	c.Assert(err, NotNil)
+	c.Assert(cmd.Cleanup(), IsNil)
+}
+
+func (s *CmdTestSuite) TestCleanupWithOutcome(c *C) {
+	cmd := s.d.Command(baseContainer(c), "date")
+	cmd.KeepContainer = true
+	c.Assert(cmd.Run(), IsNil)
+
+	res, err := cmd.CleanupWithOutcome()
+	c.Assert(err, IsNil)
+	c.Assert(res, Equals, dexec.CleanupRemoved)
+	res, err = cmd.CleanupWithOutcome()
+	c.Assert(err, IsNil)
+	c.Assert(res, Equals, dexec.CleanupAlreadyGone)
+}
+
+func (s *CmdTestSuite) TestCleanupWithOutcomeRemovedBySomeoneElse(c *C) {
+	opts := baseOpts()
+	name := opts.Name
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "date")
+	cmd.KeepContainer = true
+	c.Assert(cmd.Run(), IsNil)
+
+	c.Assert(testDocker(c).RemoveContainer(docker.RemoveContainerOptions{ID: name, Force: true}), IsNil)
+	res, err := cmd.CleanupWithOutcome()
+	c.Assert(err, IsNil)
+	c.Assert(res, Equals, dexec.CleanupAlreadyGone)
+}
+
+func (s *CmdTestSuite) TestCleanupWithOutcomeNotStarted(c *C) {
+	cmd := s.d.Command(baseContainer(c), "date")
+	res, err := cmd.CleanupWithOutcome()
+	c.Assert(err, ErrorMatches, "dexec: not started")
+	c.Assert(res, Equals, dexec.CleanupFailed)
+}
+
+func (s *CmdTestSuite) TestRequireDigestRejectsTag(c *C) {
+	cmd := s.d.Command(baseContainer(c), "echo")
+	cmd.RequireDigest = true
+	err := cmd.Start()
+	c.Assert(err, ErrorMatches, `dexec: image "busybox" is not pinned by digest.*`)
+}
+
+func (s *CmdTestSuite) TestSignaledExitCode(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "exit 137")
+	err := cmd.Run()
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err, ErrorMatches, `dexec: "sh -c exit 137" in container [0-9a-f]{12}: exit status: 137 \(signal: killed\)`)
+
+	sig, ok := dexec.IsSignaled(err)
+	c.Assert(ok, Equals, true)
+	c.Assert(sig, Equals, syscall.SIGKILL)
+
+	_, ok = dexec.IsSignaled(s.d.Command(baseContainer(c), "false").Run())
+	c.Assert(ok, Equals, false)
+}
+
+func (s *CmdTestSuite) TestInspectBeforeStart(c *C) {
+	cmd := s.d.Command(baseContainer(c), "echo")
+	_, err := cmd.Inspect()
+	c.Assert(err, ErrorMatches, "dexec: not started")
+}
+
+func (s *CmdTestSuite) TestInspect(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sleep", "1")
+	c.Assert(cmd.Start(), IsNil)
+	defer cmd.Wait()
+
+	info, err := cmd.Inspect()
+	c.Assert(err, IsNil)
+	c.Assert(info.ID, Not(Equals), "")
+	c.Assert(info.State, Equals, "running")
+	c.Assert(info.Pid, Not(Equals), 0)
+	c.Assert(info.StartedAt.IsZero(), Equals, false)
+}
+
+func (s *CmdTestSuite) TestInvalidSysctl(c *C) {
+	opts := baseOpts()
+	opts.HostConfig = &docker.HostConfig{Sysctls: map[string]string{"net ipv4": "1"}}
+	_, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, ErrorMatches, `dexec: invalid sysctl name: "net ipv4"`)
+}
+
+func (s *CmdTestSuite) TestRunWithSysctl(c *C) {
+	opts := baseOpts()
+	opts.HostConfig = &docker.HostConfig{Sysctls: map[string]string{"net.ipv4.ip_unprivileged_port_start": "80"}}
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+
+	b, err := s.d.Command(e, "cat", "/proc/sys/net/ipv4/ip_unprivileged_port_start").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "80\n")
+}
+
+func (s *CmdTestSuite) TestInvalidExtraHost(c *C) {
+	for _, h := range []string{"foo", "foo:", ":10.0.0.1", "foo:bar", "10.0.0.1"} {
+		opts := baseOpts()
+		opts.HostConfig = &docker.HostConfig{ExtraHosts: []string{h}}
+		_, err := dexec.ByCreatingContainer(opts)
+		c.Assert(err, ErrorMatches, `dexec: invalid extra host .*`, Commentf("%q", h))
+	}
+}
+
+func (s *CmdTestSuite) TestRunWithExtraHosts(c *C) {
+	opts := baseOpts()
+	opts.HostConfig = &docker.HostConfig{ExtraHosts: []string{"foo:10.0.0.1", "bar:::1"}}
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+
+	b, err := s.d.Command(e, "cat", "/etc/hosts").Output()
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(b), "10.0.0.1\tfoo\n"), Equals, true)
+	c.Assert(strings.Contains(string(b), "::1\tbar\n"), Equals, true)
+}
+
+func (s *CmdTestSuite) TestInvalidCPUSet(c *C) {
+	for _, set := range []string{"a", "1-", "-1", "3-1", "0,,1", "0-1-2", " 1"} {
+		opts := baseOpts()
+		opts.HostConfig = &docker.HostConfig{CPUSetCPUs: set}
+		_, err := dexec.ByCreatingContainer(opts)
+		c.Assert(err, ErrorMatches, `dexec: invalid HostConfig\.CPUSetCPUs .*`, Commentf("%q", set))
+
+		opts.HostConfig = &docker.HostConfig{CPUSetMEMs: set}
+		_, err = dexec.ByCreatingContainer(opts)
+		c.Assert(err, ErrorMatches, `dexec: invalid HostConfig\.CPUSetMEMs .*`, Commentf("%q", set))
+	}
+}
+
+func (s *CmdTestSuite) TestRunWithCPUSet(c *C) {
+	opts := baseOpts()
+	opts.HostConfig = &docker.HostConfig{CPUSetCPUs: "0", CPUSetMEMs: "0"}
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+
+	b, err := s.d.Command(e, "grep", "Cpus_allowed_list", "/proc/self/status").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "Cpus_allowed_list:\t0\n")
+}
+
+func (s *CmdTestSuite) TestInvalidMemorySwap(c *C) {
+	swappiness := func(n int64) *int64 { return &n }
+	for _, hc := range []docker.HostConfig{
+		{MemorySwap: -2},
+		{MemorySwap: 64 << 20},
+		{Memory: 64 << 20, MemorySwap: 32 << 20},
+		{Memory: 64 << 20, MemorySwappiness: swappiness(101)},
+		{Memory: 64 << 20, MemorySwappiness: swappiness(-2)},
+	} {
+		opts := baseOpts()
+		opts.HostConfig = &hc
+		_, err := dexec.ByCreatingContainer(opts)
+		c.Assert(err, ErrorMatches, `dexec: .*HostConfig\.Memory.*`, Commentf("%+v", hc))
+	}
+}
+
+func (s *CmdTestSuite) TestRunWithMemorySwap(c *C) {
+	swappiness := int64(0)
+	for _, swap := range []int64{-1, 64 << 20, 128 << 20} {
+		opts := baseOpts()
+		opts.HostConfig = &docker.HostConfig{Memory: 64 << 20, MemorySwap: swap, MemorySwappiness: &swappiness}
+		e, err := dexec.ByCreatingContainer(opts)
+		c.Assert(err, IsNil)
+		cmd := s.d.Command(e, "true")
+		cmd.KeepContainer = true
+		c.Assert(cmd.Run(), IsNil)
+		info, err := cmd.Inspect()
+		c.Assert(err, IsNil)
+		ct, err := s.d.InspectContainer(info.ID)
+		c.Assert(err, IsNil)
+		c.Assert(ct.HostConfig.MemorySwap, Equals, swap)
+		c.Assert(cmd.Cleanup(), IsNil)
+	}
+}
+
+func (s *CmdTestSuite) TestOnCleanupErrorNotCalledForRemovedContainer(c *C) {
+	opts := baseOpts()
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "sleep", "10")
+	called := false
+	cmd.OnCleanupError = func(id string, err error) { called = true }
+	c.Assert(cmd.Start(), IsNil)
+
+	// remove the container behind dexec's back, cleanup has nothing to do
+	info, err := cmd.Inspect()
+	c.Assert(err, IsNil)
+	err = s.d.RemoveContainer(docker.RemoveContainerOptions{ID: info.ID, Force: true})
+	c.Assert(err, IsNil)
+
+	c.Assert(cmd.Wait(), NotNil)
+	c.Assert(called, Equals, false)
+}
+
+func (s *CmdTestSuite) TestExitCodeCapturedWhenContainerRemoved(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "exit 3")
+	c.Assert(cmd.Start(), IsNil)
+	info, err := cmd.Inspect()
+	c.Assert(err, IsNil)
+
+	// let the container exit, then remove it before calling Wait
+	time.Sleep(time.Second)
+	err = s.d.RemoveContainer(docker.RemoveContainerOptions{ID: info.ID, Force: true})
+	c.Assert(err, IsNil)
+
+	err = cmd.Wait()
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 3)
+}
+
+type failingWriter struct{ n int }
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	w.n++
+	return 0, errors.New("disk full")
+}
+
+func (s *CmdTestSuite) TestStdoutWriteErrorDoesNotAbort(c *C) {
+	var errOut bytes.Buffer
+	w := &failingWriter{}
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "for i in `seq 0 9`; do echo $i; done; >&2 echo done")
+	cmd.Stdout, cmd.Stderr = w, &errOut
+	err := cmd.Run()
+	c.Assert(err, ErrorMatches, "dexec: error writing to Stdout: disk full")
+	c.Assert(w.n, Equals, 1)
+	c.Assert(errOut.String(), Equals, "done\n")
+}
+
+func (s *CmdTestSuite) TestWaitHealthy(c *C) {
+	opts := baseOpts()
+	opts.Config.Healthcheck = &docker.HealthConfig{
+		Test:     []string{"CMD-SHELL", "test -f /tmp/ready"},
+		Interval: 100 * time.Millisecond,
+	}
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+
+	cmd := s.d.Command(e, "sh", "-c", "sleep 1; touch /tmp/ready; sleep 5")
+	c.Assert(cmd.Start(), IsNil)
+	defer cmd.Wait()
+	c.Assert(cmd.WaitHealthy(10*time.Second), IsNil)
+}
+
+func (s *CmdTestSuite) TestWaitHealthyNoHealthCheck(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sleep", "1")
+	c.Assert(cmd.Start(), IsNil)
+	defer cmd.Wait()
+	c.Assert(cmd.WaitHealthy(time.Second), ErrorMatches, "dexec: container has no health check")
+}
+
+func (s *CmdTestSuite) TestOnOutput(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "echo out1; sleep .5; >&2 echo err; sleep .5; printf out2")
+	var lines []dexec.OutputLine
+	cmd.OnOutput = func(l dexec.OutputLine) { lines = append(lines, l) }
+	b, err := cmd.Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "out1\nout2")
+
+	c.Assert(lines, HasLen, 3)
+	c.Assert(lines[0].Stream, Equals, "stdout")
+	c.Assert(lines[0].Text, Equals, "out1")
+	c.Assert(lines[1].Stream, Equals, "stderr")
+	c.Assert(lines[1].Text, Equals, "err")
+	c.Assert(lines[2].Stream, Equals, "stdout")
+	c.Assert(lines[2].Text, Equals, "out2")
+	c.Assert(lines[1].Time.After(lines[0].Time), Equals, true)
+	c.Assert(lines[2].Time.After(lines[1].Time), Equals, true)
+}
+
+func (s *CmdTestSuite) TestExecuteAndWaitStdoutAlreadySet(c *C) {
+	var b bytes.Buffer
+	cmd := s.d.Command(baseContainer(c), "env")
+	cmd.Stdout = &b
+	_, err := cmd.ExecuteAndWait()
+	c.Assert(err, ErrorMatches, "dexec: Stdout already configured as a writer; cannot use ExecuteAndWait")
+}
+
+func (s *CmdTestSuite) TestExecuteAndWait(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "echo out; >&2 echo err; exit 3")
+	r, err := cmd.ExecuteAndWait()
+	c.Assert(err, IsNil)
+	c.Assert(string(r.Stdout), Equals, "out\n")
+	c.Assert(string(r.Stderr), Equals, "err\n")
+	c.Assert(r.ExitCode, Equals, 3)
+	c.Assert(r.Duration > 0, Equals, true)
+}
+
+func (s *CmdTestSuite) TestExecuteAndWaitFailure(c *C) {
+	_, err := s.d.Command(baseContainer(c), "no-such-program").ExecuteAndWait()
+	c.Assert(err, NotNil)
+	c.Assert(err, Not(FitsTypeOf), &dexec.ExitError{})
+}
+
+func (s *CmdTestSuite) TestDetach(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sleep", "10")
+	c.Assert(cmd.Start(), IsNil)
+	info, err := cmd.Inspect()
+	c.Assert(err, IsNil)
+
+	done := make(chan error)
+	go func() { done <- cmd.Wait() }()
+	c.Assert(cmd.Detach(), IsNil)
+	select {
+	case err := <-done:
+		c.Assert(err, Equals, dexec.ErrDetached)
+	case <-time.After(5 * time.Second):
+		c.Fatal("Wait did not return after Detach")
+	}
+
+	ct, err := s.d.InspectContainer(info.ID)
+	c.Assert(err, IsNil)
+	c.Assert(ct.State.Running, Equals, true)
+
+	c.Assert(cmd.Cleanup(), IsNil)
+	_, err = s.d.InspectContainer(info.ID)
+	c.Assert(err, NotNil)
+}
+
+func (s *CmdTestSuite) TestDetachKeys(c *C) {
+	opts := baseOpts()
+	opts.Config.Tty = true
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "sleep", "10")
+	cmd.DetachKeys = "ctrl-x,y"
+	cmd.Stdin = strings.NewReader("\x18y")
+	c.Assert(cmd.Start(), IsNil)
+	info, err := cmd.Inspect()
+	c.Assert(err, IsNil)
+
+	c.Assert(cmd.Wait(), Equals, dexec.ErrDetached)
+	ct, err := s.d.InspectContainer(info.ID)
+	c.Assert(err, IsNil)
+	c.Assert(ct.State.Running, Equals, true)
+	c.Assert(cmd.Cleanup(), IsNil)
+}
+
+func (s *CmdTestSuite) TestTtyOutputClosedNotDetached(c *C) {
+	opts := baseOpts()
+	opts.Config.Tty = true
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+	// the terminal stream ends well before the command exits
+	cmd := s.d.Command(e, "sh", "-c", "exec </dev/null >/dev/null 2>&1; sleep 2")
+	cmd.Stdin = strings.NewReader("")
+	c.Assert(cmd.Start(), IsNil)
+	info, err := cmd.Inspect()
+	c.Assert(err, IsNil)
+
+	c.Assert(cmd.Wait(), IsNil)
+	_, err = s.d.InspectContainer(info.ID)
+	c.Assert(err, NotNil)
+}
+
+func (s *CmdTestSuite) TestInvalidDetachKeys(c *C) {
+	opts := baseOpts()
+	opts.Config.Tty = true
+	for _, keys := range []string{"ctrl-", "ctrl-1", "ab", "a,,b"} {
+		e, err := dexec.ByCreatingContainer(opts)
+		c.Assert(err, IsNil)
+		cmd := s.d.Command(e, "true")
+		cmd.DetachKeys = keys
+		c.Assert(cmd.Start(), ErrorMatches, "dexec: invalid detach key .*")
+	}
+}
+
+func (s *CmdTestSuite) TestDetachKeysWithoutTty(c *C) {
+	cmd := s.d.Command(baseContainer(c), "true")
+	cmd.DetachKeys = "ctrl-x"
+	c.Assert(cmd.Start(), ErrorMatches, "dexec: DetachKeys requires Config.Tty")
+}
+
+func (s *CmdTestSuite) TestNegativeStopTimeout(c *C) {
+	cmd := s.d.Command(baseContainer(c), "echo")
+	cmd.StopTimeout = -time.Second
+	c.Assert(cmd.Start(), ErrorMatches, "dexec: StopTimeout is negative")
+}
+
+func (s *CmdTestSuite) TestCleanupStopsGracefully(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "trap 'exit 0' TERM; while true; do sleep .1; done")
+	cmd.StopTimeout = 5 * time.Second
+	c.Assert(cmd.Start(), IsNil)
+	c.Assert(cmd.Detach(), IsNil)
+
+	start := time.Now()
+	c.Assert(cmd.Cleanup(), IsNil)
+	c.Assert(time.Since(start) < 5*time.Second, Equals, true) // exited on SIGTERM
+}
+
+func (s *CmdTestSuite) TestNegativeAttachTimeout(c *C) {
+	cmd := s.d.Command(baseContainer(c), "echo")
+	cmd.AttachTimeout = -time.Second
+	c.Assert(cmd.Start(), ErrorMatches, "dexec: AttachTimeout is negative")
+}
+
+func (s *CmdTestSuite) TestAttachTimeoutNotReached(c *C) {
+	cmd := s.d.Command(baseContainer(c), "echo", "foo")
+	cmd.AttachTimeout = 10 * time.Second
+	b, err := cmd.Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "foo\n")
+}
+
+func (s *CmdTestSuite) TestFinalState(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "exit 3")
+	c.Assert(cmd.Start(), IsNil)
+	_, err := cmd.FinalState()
+	c.Assert(err, ErrorMatches, "dexec: container has not exited")
+
+	c.Assert(cmd.Wait(), FitsTypeOf, &dexec.ExitError{})
+	st, err := cmd.FinalState()
+	c.Assert(err, IsNil)
+	c.Assert(st.ExitCode, Equals, 3)
+	c.Assert(st.OOMKilled, Equals, false)
+	c.Assert(st.FinishedAt.Before(st.StartedAt), Equals, false)
+}
+
+func (s *CmdTestSuite) TestConcurrentCommands(c *C) {
+	const n = 20
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			b, err := s.d.Command(baseContainer(c), "echo", fmt.Sprint(i)).Output()
+			c.Check(err, IsNil)
+			c.Check(string(b), Equals, fmt.Sprintf("%d\n", i))
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (s *CmdTestSuite) TestWaitStatusBeforeStart(c *C) {
+	ec, err := s.d.Command(baseContainer(c), "echo").WaitStatus()
+	c.Assert(err, ErrorMatches, "dexec: not started")
+	c.Assert(ec, Equals, -1)
+}
+
+func (s *CmdTestSuite) TestWaitStatus(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "exit 3")
+	c.Assert(cmd.Start(), IsNil)
+	ec, err := cmd.WaitStatus()
+	c.Assert(err, IsNil)
+	c.Assert(ec, Equals, 3)
+}
+
+func (s *CmdTestSuite) TestAddStdoutWriter(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "echo out; >&2 echo err")
+	var tee, teeErr bytes.Buffer
+	c.Assert(cmd.AddStdoutWriter(&tee), IsNil)
+	c.Assert(cmd.AddStderrWriter(&teeErr), IsNil)
+	b, err := cmd.Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "out\n")
+	c.Assert(tee.String(), Equals, "out\n")
+	c.Assert(teeErr.String(), Equals, "err\n")
+	c.Assert(cmd.AddStdoutWriter(&tee), ErrorMatches, "dexec: already started")
+}
+
+func (s *CmdTestSuite) TestAddStdoutWriterFailing(c *C) {
+	cmd := s.d.Command(baseContainer(c), "echo", "out")
+	c.Assert(cmd.AddStdoutWriter(&failingWriter{}), IsNil)
+	b, err := cmd.Output()
+	c.Assert(err, ErrorMatches, "dexec: error writing to Stdout: disk full")
+	c.Assert(string(b), Equals, "out\n")
+}
+
+func (s *CmdTestSuite) TestOutputMaxOutputBytes(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "for i in `seq 1 10000`; do echo 0123456789; done")
+	cmd.MaxOutputBytes = 25
+	b, err := cmd.Output()
+	c.Assert(err, Equals, dexec.ErrOutputTruncated)
+	c.Assert(string(b), Equals, "0123456789\n0123456789\n012")
+}
+
+func (s *CmdTestSuite) TestChanges(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "touch /tmp/foo; rm /bin/ls")
+	cmd.KeepContainer = true
+	c.Assert(cmd.Run(), IsNil)
+	defer cmd.Cleanup()
+
+	l, err := cmd.Changes()
+	c.Assert(err, IsNil)
+	m := make(map[string]dexec.ChangeKind)
+	for _, ch := range l {
+		m[ch.Path] = ch.Kind
+	}
+	c.Assert(m["/tmp/foo"], Equals, dexec.ChangeAdded)
+	c.Assert(m["/bin/ls"], Equals, dexec.ChangeDeleted)
+	c.Assert(m["/tmp"], Equals, dexec.ChangeModified)
+}
+
+func (s *CmdTestSuite) TestChangesAfterRemoval(c *C) {
+	cmd := s.d.Command(baseContainer(c), "true")
+	c.Assert(cmd.Run(), IsNil)
+	_, err := cmd.Changes()
+	c.Assert(err, ErrorMatches, "dexec: container is removed")
+}
+
+func (s *CmdTestSuite) TestSignal(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "trap 'echo got hup; exit 0' HUP; while true; do sleep .1; done")
+	var b bytes.Buffer
+	cmd.Stdout = &b
+	c.Assert(cmd.Signal(syscall.SIGHUP), ErrorMatches, "dexec: command is not running")
+	c.Assert(cmd.Start(), IsNil)
+	time.Sleep(500 * time.Millisecond) // let the trap be installed
+	c.Assert(cmd.Signal(syscall.SIGHUP), IsNil)
+	c.Assert(cmd.Wait(), IsNil)
+	c.Assert(b.String(), Equals, "got hup\n")
+
+	c.Assert(cmd.Signal(syscall.SIGHUP), ErrorMatches, "dexec: command is not running")
+}
+
+func (s *CmdTestSuite) TestSecretRelativeTarget(c *C) {
+	cmd := s.d.Command(baseContainer(c), "true")
+	cmd.Secrets = []dexec.Secret{{Target: "token", Data: []byte("s3cr3t")}}
+	c.Assert(cmd.Start(), ErrorMatches, `dexec: secret target must be an absolute path: "token"`)
+}
+
+func (s *CmdTestSuite) TestSecrets(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "cat /run/secrets/token; stat -c %a /run/secrets/token; env")
+	cmd.Secrets = []dexec.Secret{{Target: "/run/secrets/token", Data: []byte("s3cr3t\n"), Mode: 0444}}
+	b, err := cmd.Output()
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(string(b), "s3cr3t\n444\n"), Equals, true)
+	c.Assert(strings.Count(string(b), "s3cr3t"), Equals, 1) // not in env
+
+	m, err := filepath.Glob("/dev/shm/dexec-secrets-*")
+	c.Assert(err, IsNil)
+	c.Assert(m, HasLen, 0)
+}
+
+func (s *CmdTestSuite) TestSecretsRemovedOnStartFailure(c *C) {
+	cmd := s.d.Command(baseContainer(c), "no-such-program")
+	cmd.Secrets = []dexec.Secret{{Target: "/token", Data: []byte("s3cr3t")}}
+	c.Assert(cmd.Start(), NotNil)
+
+	m, err := filepath.Glob("/dev/shm/dexec-secrets-*")
+	c.Assert(err, IsNil)
+	c.Assert(m, HasLen, 0)
+}
+
+func (s *CmdTestSuite) TestServeTerminal(c *C) {
+	opts := baseOpts()
+	opts.Config.Tty = true
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "sh")
+
+	var out bytes.Buffer
+	conn := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader("sleep 1; stty size; exit 3\n"), &out}
+	sizes := make(chan dexec.TerminalSize, 1)
+	sizes <- dexec.TerminalSize{Cols: 100, Rows: 40}
+
+	err = dexec.ServeTerminal(cmd, conn, sizes)
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 3)
+	c.Assert(strings.Contains(out.String(), "40 100"), Equals, true)
+}
+
+func (s *CmdTestSuite) TestServeTerminalStreamsSet(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh")
+	cmd.Stdout = new(bytes.Buffer)
+	err := dexec.ServeTerminal(cmd, new(bytes.Buffer), nil)
+	c.Assert(err, ErrorMatches, "dexec: Stdout already configured as a writer; cannot use ServeTerminal")
+}
+
+func (s *CmdTestSuite) TestTTYSize(c *C) {
+	opts := baseOpts()
+	opts.Config.Tty = true
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "sh", "-c", "sleep 1; stty size")
+	cmd.TTYWidth, cmd.TTYHeight = 100, 40
+	b, err := cmd.Output()
+	c.Assert(err, IsNil)
+	c.Assert(strings.TrimSpace(string(b)), Equals, "40 100")
+}
+
+func (s *CmdTestSuite) TestTTYSizeIncomplete(c *C) {
+	opts := baseOpts()
+	opts.Config.Tty = true
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "true")
+	cmd.TTYWidth = 100
+	c.Assert(cmd.Start(), ErrorMatches, "dexec: TTYWidth and TTYHeight must be set together")
+}
+
+func (s *CmdTestSuite) TestResize(c *C) {
+	opts := baseOpts()
+	opts.Config.Tty = true
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "sh", "-c", "sleep 2; stty size")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	c.Assert(cmd.Resize(80, 24), ErrorMatches, "dexec: not started")
+	c.Assert(cmd.Start(), IsNil)
+	c.Assert(cmd.Resize(120, 50), IsNil)
+	c.Assert(cmd.Wait(), IsNil)
+	c.Assert(strings.TrimSpace(out.String()), Equals, "50 120")
+	c.Assert(cmd.Resize(80, 24), ErrorMatches, "dexec: command is not running")
+}
+
+func (s *CmdTestSuite) TestResizeWithoutTty(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sleep", "1")
+	c.Assert(cmd.Start(), IsNil)
+	c.Assert(cmd.Resize(80, 24), ErrorMatches, "dexec: command has no terminal")
+	c.Assert(cmd.Wait(), IsNil)
+}
+
+func (s *CmdTestSuite) TestStderrTail(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "echo first >&2; echo last >&2; exit 2")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.StderrTail = 5
+	err := cmd.Run()
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(string(err.(*dexec.ExitError).Stderr), Equals, "last\n")
+	c.Assert(stderr.String(), Equals, "first\nlast\n")
+}
+
+func (s *CmdTestSuite) TestIdleTimeout(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "echo hi; sleep 30")
+	cmd.IdleTimeout = time.Second
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	start := time.Now()
+	c.Assert(cmd.Run(), Equals, dexec.ErrIdleTimeout)
+	c.Assert(time.Since(start) < 10*time.Second, Equals, true)
+	c.Assert(out.String(), Equals, "hi\n")
+}
+
+func (s *CmdTestSuite) TestIdleTimeoutNotExceeded(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "for i in 1 2 3 4; do echo $i >&2; sleep 0.5; done")
+	cmd.IdleTimeout = 2 * time.Second
+	c.Assert(cmd.Run(), IsNil)
+}
+
+func (s *CmdTestSuite) TestNegativeIdleTimeout(c *C) {
+	cmd := s.d.Command(baseContainer(c), "true")
+	cmd.IdleTimeout = -time.Second
+	c.Assert(cmd.Run(), ErrorMatches, "dexec: IdleTimeout is negative")
+}
+
+func (s *CmdTestSuite) TestSeparatedOutput(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "echo out; echo warning >&2")
+	stdout, stderr, err := cmd.SeparatedOutput()
+	c.Assert(err, IsNil)
+	c.Assert(string(stdout), Equals, "out\n")
+	c.Assert(string(stderr), Equals, "warning\n")
+}
+
+func (s *CmdTestSuite) TestSeparatedOutputFailure(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "echo out; echo first >&2; echo last >&2; exit 3")
+	cmd.StderrTail = 5
+	stdout, stderr, err := cmd.SeparatedOutput()
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 3)
+	c.Assert(string(err.(*dexec.ExitError).Stderr), Equals, "first\nlast\n")
+	c.Assert(string(stdout), Equals, "out\n")
+	c.Assert(string(stderr), Equals, "first\nlast\n")
+}
+
+func (s *CmdTestSuite) TestSeparatedOutputStreamsSet(c *C) {
+	cmd := s.d.Command(baseContainer(c), "true")
+	cmd.Stderr = new(bytes.Buffer)
+	_, _, err := cmd.SeparatedOutput()
+	c.Assert(err, ErrorMatches, "dexec: Stderr already configured as a writer; cannot use SeparatedOutput")
+}
+
+func (s *CmdTestSuite) TestKill(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sleep", "30")
+	c.Assert(cmd.Kill(), ErrorMatches, "dexec: command is not running")
+
+	done := make(chan error)
+	go func() {
+		_, err := cmd.Output()
+		done <- err
+	}()
+	// Output starts the command asynchronously, so retry until it runs.
+	deadline := time.Now().Add(10 * time.Second)
+	for cmd.Kill() != nil {
+		c.Assert(time.Now().Before(deadline), Equals, true, Commentf("command did not start"))
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		c.Assert(err, Equals, dexec.ErrKilled)
+	case <-time.After(10 * time.Second):
+		c.Fatal("Output did not return after Kill")
+	}
+	c.Assert(cmd.Kill(), ErrorMatches, "dexec: command is not running")
+}
+
+type closeRecorder struct {
+	bytes.Buffer
+	closed int
+	err    error
+}
+
+func (w *closeRecorder) Close() error {
+	w.closed++
+	return w.err
+}
+
+func (s *CmdTestSuite) TestSetStdoutCloser(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "echo out; echo err >&2")
+	stdout, stderr := &closeRecorder{}, &closeRecorder{}
+	c.Assert(cmd.SetStdoutCloser(stdout), IsNil)
+	c.Assert(cmd.SetStderrCloser(stderr), IsNil)
+	c.Assert(cmd.SetStdoutCloser(stdout), ErrorMatches, "dexec: Stdout already configured as a closing writer; cannot use SetStdoutCloser")
+	c.Assert(cmd.Run(), IsNil)
+	c.Assert(stdout.String(), Equals, "out\n")
+	c.Assert(stderr.String(), Equals, "err\n")
+	c.Assert(stdout.closed, Equals, 1)
+	c.Assert(stderr.closed, Equals, 1)
+}
+
+func (s *CmdTestSuite) TestSetStdoutCloserError(c *C) {
+	cmd := s.d.Command(baseContainer(c), "echo", "hello")
+	w := &closeRecorder{err: errors.New("upload failed")}
+	c.Assert(cmd.SetStdoutCloser(w), IsNil)
+	c.Assert(cmd.Run(), ErrorMatches, ".*upload failed.*")
+	c.Assert(w.closed, Equals, 1)
+}
+
+func (s *CmdTestSuite) TestWaitForState(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sleep", "10")
+	c.Assert(cmd.Start(), IsNil)
+	c.Assert(cmd.WaitForState("running", 10*time.Second), IsNil)
+	info, err := cmd.Inspect()
+	c.Assert(err, IsNil)
+
+	c.Assert(s.d.PauseContainer(info.ID), IsNil)
+	c.Assert(cmd.WaitForState("paused", 10*time.Second), IsNil)
+	c.Assert(s.d.UnpauseContainer(info.ID), IsNil)
+	c.Assert(cmd.WaitForState("restarting", time.Second), ErrorMatches, "dexec: timed out waiting for container to be restarting")
+
+	c.Assert(cmd.Kill(), IsNil)
+	c.Assert(cmd.WaitForState("paused", 10*time.Second), ErrorMatches, "dexec: container exited")
+	c.Assert(cmd.Wait(), Equals, dexec.ErrKilled)
+}
+
+func (s *CmdTestSuite) TestWaitForUnknownState(c *C) {
+	cmd := s.d.Command(baseContainer(c), "true")
+	c.Assert(cmd.WaitForState("stopped", time.Second), ErrorMatches, `dexec: unknown container state "stopped"`)
+}
+
+func (s *CmdTestSuite) TestStdinEOFTimeout(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "cat; sleep 30")
+	cmd.Stdin = strings.NewReader("input\n")
+	cmd.StdinEOFTimeout = time.Second
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	start := time.Now()
+	err := cmd.Run()
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).Signaled, Equals, true)
+	c.Assert(time.Since(start) < 10*time.Second, Equals, true)
+	c.Assert(out.String(), Equals, "input\n")
+}
+
+func (s *CmdTestSuite) TestStdinEOFTimeoutNotExceeded(c *C) {
+	cmd := s.d.Command(baseContainer(c), "cat")
+	cmd.Stdin = strings.NewReader("input\n")
+	cmd.StdinEOFTimeout = 5 * time.Second
+	b, err := cmd.Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "input\n")
+}
+
+func (s *CmdTestSuite) TestKeepKilledContainer(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "echo started; sleep 30")
+	cmd.IdleTimeout = time.Second
+	cmd.KeepKilledContainer = true
+	c.Assert(cmd.Run(), Equals, dexec.ErrIdleTimeout)
+
+	info, err := cmd.Inspect()
+	c.Assert(err, IsNil)
+	c.Assert(info.State, Equals, "exited")
+	c.Assert(cmd.Cleanup(), IsNil)
+	_, err = s.d.InspectContainer(info.ID)
+	c.Assert(err, NotNil)
+}
+
+func (s *CmdTestSuite) TestKeepKilledContainerRemovedOnExit(c *C) {
+	cmd := s.d.Command(baseContainer(c), "true")
+	cmd.KeepKilledContainer = true
+	c.Assert(cmd.Run(), IsNil)
+	_, err := cmd.Inspect()
+	c.Assert(err, NotNil)
+}
+
+func (s *CmdTestSuite) TestCombinedOutputReader(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "echo out; sleep 1; echo err >&2; exit 2")
+	r, err := cmd.CombinedOutputReader()
+	c.Assert(err, IsNil)
+
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, "out\n") // before the command exits
+	rest, err := ioutil.ReadAll(br)
+	c.Assert(err, IsNil)
+	c.Assert(string(rest), Equals, "err\n")
+
+	err = cmd.Wait()
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 2)
+}
+
+func (s *CmdTestSuite) TestCombinedOutputReaderClose(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "while true; do echo y; sleep 0.1; done")
+	r, err := cmd.CombinedOutputReader()
+	c.Assert(err, IsNil)
+	_, err = bufio.NewReader(r).ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(r.Close(), IsNil)
+
+	done := make(chan error)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		c.Assert(err, Equals, dexec.ErrKilled)
+	case <-time.After(10 * time.Second):
+		c.Fatal("Wait did not return after closing the reader")
+	}
+}
+
+func (s *CmdTestSuite) TestCheckBindSources(c *C) {
+	opts := baseOpts()
+	opts.HostConfig = &docker.HostConfig{Binds: []string{"/no/such/dexec/path:/data"}}
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "ls", "/data")
+	cmd.CheckBindSources = true
+	err = cmd.Start()
+	c.Assert(err, FitsTypeOf, &dexec.MountSourceError{})
+	c.Assert(err.(*dexec.MountSourceError).Source, Equals, "/no/such/dexec/path")
+}
+
+func (s *CmdTestSuite) TestOnEvent(c *C) {
+	opts := baseOpts()
+	opts.HostConfig = &docker.HostConfig{Memory: 16 << 20, MemorySwap: 16 << 20}
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "dd", "if=/dev/zero", "of=/dev/null", "bs=64M", "count=1")
+	var actions []string
+	cmd.OnEvent = func(ev dexec.ContainerEvent) { actions = append(actions, ev.Action) }
+	c.Assert(cmd.Run(), NotNil)
+
+	c.Assert(len(actions) > 0, Equals, true)
+	c.Assert(actions[0], Equals, "start")
+	c.Assert(actions[len(actions)-1], Equals, "die")
+	c.Assert(strings.Contains(strings.Join(actions, ","), "oom"), Equals, true, Commentf("%v", actions))
+}
+
+func (s *CmdTestSuite) TestRequireNativePlatform(c *C) {
+	cmd := s.d.Command(baseContainer(c), "echo", "native")
+	cmd.RequireNativePlatform = true
+	b, err := cmd.Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "native\n")
+}
+
+func (s *CmdTestSuite) TestUmask(c *C) {
+	mask := os.FileMode(0002)
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", `umask; touch /tmp/f; stat -c %a /tmp/f`)
+	cmd.Umask = &mask
+	b, err := cmd.Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "0002\n664\n")
+}
+
+func (s *CmdTestSuite) TestInvalidUmask(c *C) {
+	mask := os.FileMode(01000)
+	cmd := s.d.Command(baseContainer(c), "true")
+	cmd.Umask = &mask
+	c.Assert(cmd.Run(), ErrorMatches, "dexec: invalid Umask 01000")
+}
+
+func (s *CmdTestSuite) TestSession(c *C) {
+	opts := baseOpts()
+	opts.Config.Env = []string{"JOB=build"}
+	sess, err := s.d.NewSession(opts)
+	c.Assert(err, IsNil)
+	defer sess.Close()
+
+	c.Assert(sess.Command("sh", "-c", "echo $JOB > /tmp/step").Run(), IsNil)
+
+	cmd := sess.Command("cat", "/tmp/step")
+	b, err := cmd.Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "build\n")
+
+	cmd = sess.Command("cat")
+	cmd.Stdin = strings.NewReader("input")
+	cmd.Dir = "/tmp"
+	b, err = cmd.Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "input")
+
+	err = sess.Command("sh", "-c", "exit 3").Run()
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 3)
+
+	c.Assert(sess.Close(), IsNil)
+	_, err = s.d.InspectContainer(sess.ID())
+	c.Assert(err, NotNil)
+	c.Assert(sess.Close(), IsNil)
+}
+
+func (s *CmdTestSuite) TestSessionUnsupported(c *C) {
+	sess, err := s.d.NewSession(baseOpts())
+	c.Assert(err, IsNil)
+	defer sess.Close()
+
+	cmd := sess.Command("true")
+	cmd.KeepContainer = true
+	c.Assert(cmd.Run(), ErrorMatches, "dexec: KeepContainer is not supported for Session commands")
+}
+
+func (s *CmdTestSuite) TestSessionCombinedOutputReaderClose(c *C) {
+	sess, err := s.d.NewSession(baseOpts())
+	c.Assert(err, IsNil)
+	defer sess.Close()
+
+	cmd := sess.Command("sleep", "1")
+	r, err := cmd.CombinedOutputReader()
+	c.Assert(err, IsNil)
+	c.Assert(r.Close(), ErrorMatches, "dexec: Kill is not supported for Session commands")
+	c.Assert(cmd.Wait(), IsNil) // exits by itself
+}
@@ -16,6 +16,19 @@
 // The package needs the following dependencies to work:
 //  go get github.com/fsouza/go-dockerclient
 //
+// Testing
+//
+// dexec talks to Docker only through the *docker.Client in Docker, so code
+// using it can be tested without a Docker engine by pointing the client at
+// the in-memory fake server in github.com/fsouza/go-dockerclient/testing:
+//  srv, _ := testing.NewServer("127.0.0.1:0", nil, nil)
+//  cl, _ := docker.NewClient(srv.URL())
+//  d := dexec.Docker{cl}
+// The fake server does not run commands; its containers keep running until
+// they are stopped or their state is changed with MutateContainer, which is
+// how a test decides the exit code that Wait sees. Custom handlers can be
+// installed with CustomHandler to emulate other behavior, such as output.
+//
 // Known issues
 //
 // - You may receive empty stdout/stderr from commands if the executed command
@@ -0,0 +1,95 @@
+package dexec
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// eventGracePeriod is how long Wait waits for the "die" event of an exited
+// container before it stops watching events.
+const eventGracePeriod = time.Second
+
+// ContainerEvent is an event reported by Docker for the container executing a
+// command, such as "oom" when the command exceeds its memory limit. Other
+// common actions are "start", "kill", "pause", "unpause" and "die", which is
+// the last event reported before Wait returns.
+type ContainerEvent struct {
+	// Action is the kind of event, such as "oom".
+	Action string
+
+	// Time is when the event happened.
+	Time time.Time
+
+	// Attributes holds details of the event, such as "exitCode" for "die"
+	// and "signal" for "kill", along with the labels of the container.
+	Attributes map[string]string
+}
+
+// containerEvent converts ev to a ContainerEvent if it is about container id.
+func containerEvent(ev *docker.APIEvents, id string) (ContainerEvent, bool) {
+	if ev == nil || ev.Type != "container" || ev.Actor.ID != id {
+		return ContainerEvent{}, false
+	}
+	t := time.Unix(0, ev.TimeNano)
+	if ev.TimeNano == 0 {
+		t = time.Unix(ev.Time, 0)
+	}
+	return ContainerEvent{Action: ev.Action, Time: t, Attributes: ev.Actor.Attributes}, true
+}
+
+// eventWatcher passes the events of a container to a function.
+type eventWatcher struct {
+	ch      chan *docker.APIEvents
+	died    chan struct{} // closed on the "die" event
+	done    chan struct{} // closed to stop watching
+	stopped chan struct{} // closed once fn is no longer called
+}
+
+func watchEvents(d Docker, id string, fn func(ContainerEvent)) (*eventWatcher, error) {
+	w := &eventWatcher{
+		ch:      make(chan *docker.APIEvents, 64),
+		died:    make(chan struct{}),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if err := d.AddEventListener(w.ch); err != nil {
+		return nil, fmt.Errorf("dexec: failed to watch events: %v", err)
+	}
+	go func() {
+		defer close(w.stopped)
+		died := false
+		for {
+			select {
+			case ev := <-w.ch:
+				e, ok := containerEvent(ev, id)
+				if !ok {
+					continue
+				}
+				fn(e)
+				if e.Action == "die" && !died {
+					died = true
+					close(w.died)
+				}
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w, nil
+}
+
+// stop stops watching events, after waiting for the "die" event for up to
+// eventGracePeriod if waitDie is set. No more calls are made once it returns.
+func (w *eventWatcher) stop(d Docker, waitDie bool) {
+	if waitDie {
+		select {
+		case <-w.died:
+		case <-time.After(eventGracePeriod):
+		}
+	}
+	d.RemoveEventListener(w.ch)
+	close(w.done)
+	<-w.stopped
+}
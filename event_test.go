@@ -0,0 +1,40 @@
+package dexec
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+func TestContainerEvent(t *testing.T) {
+	attrs := map[string]string{"exitCode": "137", "image": "busybox"}
+	for _, tt := range []struct {
+		ev   *docker.APIEvents
+		want *ContainerEvent
+	}{
+		{nil, nil},
+		{&docker.APIEvents{Type: "container", Action: "oom", Actor: docker.APIActor{ID: "other"}}, nil},
+		{&docker.APIEvents{Type: "network", Action: "connect", Actor: docker.APIActor{ID: "c1"}}, nil},
+		{
+			&docker.APIEvents{Type: "container", Action: "oom", Actor: docker.APIActor{ID: "c1"}, Time: 1500000000, TimeNano: 1500000000123456789},
+			&ContainerEvent{Action: "oom", Time: time.Unix(0, 1500000000123456789)},
+		},
+		{
+			&docker.APIEvents{Type: "container", Action: "die", Actor: docker.APIActor{ID: "c1", Attributes: attrs}, Time: 1500000000},
+			&ContainerEvent{Action: "die", Time: time.Unix(1500000000, 0), Attributes: attrs},
+		},
+	} {
+		got, ok := containerEvent(tt.ev, "c1")
+		if tt.want == nil {
+			if ok {
+				t.Errorf("%+v: got event %+v; expected none", tt.ev, got)
+			}
+			continue
+		}
+		if !ok || !reflect.DeepEqual(got, *tt.want) {
+			t.Errorf("%+v: got %+v, %v; expected %+v", tt.ev, got, ok, *tt.want)
+		}
+	}
+}
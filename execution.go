@@ -4,6 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
+	"path"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 )
@@ -15,8 +21,35 @@ type Execution interface {
 	run(d Docker, stdin io.Reader, stdout, stderr io.Writer) error
 	wait(d Docker) (int, error)
 
+	cleanup(d Docker) (CleanupOutcome, error)
+	detach(d Docker) error
+	inspect(d Docker) (ContainerInfo, error)
+	containerID() string
+	finalState() (State, error)
+	changes(d Docker) ([]FileChange, error)
+	signal(d Docker, sig syscall.Signal) error
+	kill(d Docker) error
+	resize(d Docker, cols, rows uint16) error
+
 	setEnv(env []string) error
+	setInheritedEnv(env []string) error
 	setDir(dir string) error
+	setKeep(keep bool) error
+	setKeepKilled(keep bool) error
+	setRequireDigest(require bool) error
+	setCheckBindSources(check bool) error
+	setRequireNativePlatform(require bool) error
+	setEventHandler(fn func(ContainerEvent)) error
+	setCleanupErrorHook(fn func(containerID string, err error)) error
+	setStopTimeout(timeout time.Duration) error
+	setKeepEntrypoint(keep bool) error
+	setAttachTimeout(timeout time.Duration) error
+	setNoStdin(noStdin bool) error
+	setSecrets(secrets []Secret) error
+	setDetachKeys(keys string) error
+	setTerminalSize(cols, rows uint16) error
+	setIdleTimeout(timeout time.Duration) error
+	setStdinEOFTimeout(timeout time.Duration) error
 }
 
 type createContainer struct {
@@ -24,6 +57,57 @@ type createContainer struct {
 	cmd []string
 	id  string // created container id
 	cw  docker.CloseWaiter
+
+	exited   <-chan waitResult // result of waiting for the container to exit
+	final    *State            // state captured before removal
+	finalErr error
+
+	mu      sync.Mutex // guards id, killed and removed, which are read concurrently
+	killed  bool       // killed by kill
+	removed bool       // container is already removed
+
+	detachOnce sync.Once
+	detached   chan struct{} // closed on detach
+
+	keep          bool // retain container after the command exits
+	keepKilled    bool // retain container if the command is killed
+	requireDigest bool // reject images not pinned by digest
+	checkSources  bool // reject binds of missing host paths
+	nativeOnly    bool // reject images built for another platform
+	stopTimeout   time.Duration
+	attachTimeout time.Duration
+	idleTimeout   time.Duration
+	idle          *idleTimer // kills the container once output stops
+
+	stdinEOFTimeout time.Duration
+	stdinEOF        *idleTimer // started at stdin EOF, stops the container
+
+	keepEntrypoint bool // pass the command as arguments to the entrypoint
+	noStdin        bool // do not attach standard input
+	detachKeys     string
+	detachRead     chan struct{} // closed once the detach keys are read from stdin
+	ttySize        TerminalSize  // initial terminal size, if set
+
+	secrets    []Secret
+	secretsDir string // host directory of secret files, if written
+
+	onCleanupError func(containerID string, err error)
+	onEvent        func(ContainerEvent)
+	events         *eventWatcher // watches events for onEvent, if started
+}
+
+// errNotRunning is returned by the methods acting on the running command, if
+// it is not running.
+var errNotRunning = errors.New("dexec: command is not running")
+
+// detachGracePeriod is how long wait lets a container exit after the detach
+// keys are read and its streams end, before checking whether Docker detached
+// from it instead.
+const detachGracePeriod = time.Second
+
+type waitResult struct {
+	exitCode int
+	err      error
 }
 
 // ByCreatingContainer is the execution strategy where a new container with specified
@@ -31,9 +115,37 @@ type createContainer struct {
 //
 // The container will be created and started with Cmd.Start and will be deleted
 // before Cmd.Wait returns.
+//
+// The options are validated up front, so that common misconfigurations are
+// reported before any container is created, all in a single error:
+//
+// - opts.Config must be set with a non-empty Image.
+//
+// - Config.Hostname, if set, must be a valid RFC 1123 hostname.
+//
+// - Config.StopSignal, if set, must be a known signal name, including
+// real-time signals such as "SIGRTMIN+3", or a signal number. It is sent to
+// stop the container when Cmd.StopTimeout is set.
+//
+// - HostConfig.Binds must be in "src:dest[:options]" form with known options,
+// such as "ro" or propagation modes like "rslave".
+//
+// - HostConfig.Mounts, if bind mounts have BindOptions.Propagation set, must
+// use the same propagation modes as binds.
+//
+// - HostConfig.Sysctls must have valid kernel parameter names.
+//
+// - HostConfig.ExtraHosts must be in "host:ip" form.
+//
+// - HostConfig.CPUSetCPUs and HostConfig.CPUSetMEMs, if set, must be lists of
+// numbers and ranges, such as "0-3,5".
+//
+// - HostConfig.MemorySwap, if positive, must be at least HostConfig.Memory,
+// which must be set; -1 allows unlimited swap. HostConfig.MemorySwappiness, if
+// set, must be between 0 and 100, or -1 for the default.
 func ByCreatingContainer(opts docker.CreateContainerOptions) (Execution, error) {
-	if opts.Config == nil {
-		return nil, errors.New("dexec: Config is nil")
+	if err := validateOptions(opts); err != nil {
+		return nil, err
 	}
 	return &createContainer{opt: opts}, nil
 }
@@ -46,7 +158,15 @@ func (c *createContainer) setEnv(env []string) error {
 	return nil
 }
 
+func (c *createContainer) setInheritedEnv(env []string) error {
+	c.opt.Config.Env = mergeEnv(c.opt.Config.Env, env)
+	return nil
+}
+
 func (c *createContainer) setDir(dir string) error {
+	if !path.IsAbs(dir) {
+		return fmt.Errorf("dexec: Dir must be an absolute path: %q", dir)
+	}
 	if c.opt.Config.WorkingDir != "" {
 		return errors.New("dexec: Config.WorkingDir already set")
 	}
@@ -54,30 +174,179 @@ func (c *createContainer) setDir(dir string) error {
 	return nil
 }
 
+func (c *createContainer) setKeep(keep bool) error {
+	c.keep = keep
+	return nil
+}
+
+func (c *createContainer) setKeepKilled(keep bool) error {
+	c.keepKilled = keep
+	return nil
+}
+
+func (c *createContainer) setRequireDigest(require bool) error {
+	c.requireDigest = require
+	return nil
+}
+
+func (c *createContainer) setRequireNativePlatform(require bool) error {
+	c.nativeOnly = require
+	return nil
+}
+
+func (c *createContainer) setCheckBindSources(check bool) error {
+	c.checkSources = check
+	return nil
+}
+
+func (c *createContainer) setEventHandler(fn func(ContainerEvent)) error {
+	c.onEvent = fn
+	return nil
+}
+
+func (c *createContainer) setCleanupErrorHook(fn func(containerID string, err error)) error {
+	c.onCleanupError = fn
+	return nil
+}
+
+func (c *createContainer) setStopTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return errors.New("dexec: StopTimeout is negative")
+	}
+	c.stopTimeout = timeout
+	return nil
+}
+
+func (c *createContainer) setKeepEntrypoint(keep bool) error {
+	c.keepEntrypoint = keep
+	return nil
+}
+
+func (c *createContainer) setAttachTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return errors.New("dexec: AttachTimeout is negative")
+	}
+	c.attachTimeout = timeout
+	return nil
+}
+
+func (c *createContainer) setIdleTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return errors.New("dexec: IdleTimeout is negative")
+	}
+	c.idleTimeout = timeout
+	return nil
+}
+
+func (c *createContainer) setStdinEOFTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return errors.New("dexec: StdinEOFTimeout is negative")
+	}
+	c.stdinEOFTimeout = timeout
+	return nil
+}
+
+func (c *createContainer) setNoStdin(noStdin bool) error {
+	c.noStdin = noStdin
+	return nil
+}
+
+func (c *createContainer) setDetachKeys(keys string) error {
+	if !c.opt.Config.Tty {
+		return errors.New("dexec: DetachKeys requires Config.Tty")
+	}
+	if err := validateDetachKeys(keys); err != nil {
+		return err
+	}
+	c.detachKeys = keys
+	return nil
+}
+
+func (c *createContainer) setTerminalSize(cols, rows uint16) error {
+	if !c.opt.Config.Tty {
+		return errors.New("dexec: TTYWidth and TTYHeight require Config.Tty")
+	}
+	if cols == 0 || rows == 0 {
+		return errors.New("dexec: TTYWidth and TTYHeight must be set together")
+	}
+	c.ttySize = TerminalSize{cols, rows}
+	return nil
+}
+
+func (c *createContainer) setSecrets(secrets []Secret) error {
+	if err := validateSecrets(secrets); err != nil {
+		return err
+	}
+	c.secrets = secrets
+	return nil
+}
+
 func (c *createContainer) create(d Docker, cmd []string) error {
 	c.cmd = cmd
 
+	if c.requireDigest {
+		if err := validateDigest(c.opt.Config.Image); err != nil {
+			return err
+		}
+	}
+	if c.checkSources {
+		if err := checkBindSources(c.opt.HostConfig); err != nil {
+			return err
+		}
+	}
+	if c.nativeOnly {
+		if err := checkPlatform(d, c.opt.Config.Image); err != nil {
+			return err
+		}
+	}
+
 	if len(c.opt.Config.Cmd) > 0 {
 		return errors.New("dexec: Config.Cmd already set")
 	}
-	if len(c.opt.Config.Entrypoint) > 0 {
+	if len(c.opt.Config.Entrypoint) > 0 && !c.keepEntrypoint {
 		return errors.New("dexec: Config.Entrypoint already set")
 	}
 
-	c.opt.Config.AttachStdin = true
+	c.opt.Config.AttachStdin = !c.noStdin
 	c.opt.Config.AttachStdout = true
 	c.opt.Config.AttachStderr = true
-	c.opt.Config.OpenStdin = true
-	c.opt.Config.StdinOnce = true
-	c.opt.Config.Cmd = nil        // clear cmd
-	c.opt.Config.Entrypoint = cmd // set new entrypoint
+	c.opt.Config.OpenStdin = !c.noStdin
+	c.opt.Config.StdinOnce = !c.noStdin
+	if c.keepEntrypoint {
+		c.opt.Config.Cmd = cmd // arguments to the existing entrypoint
+	} else {
+		c.opt.Config.Cmd = nil        // clear cmd
+		c.opt.Config.Entrypoint = cmd // set new entrypoint
+	}
+	if argsTooLong(append(append([]string(nil), c.opt.Config.Entrypoint...), c.opt.Config.Cmd...), c.opt.Config.Env) {
+		return ErrArgListTooLong
+	}
+
+	if len(c.secrets) > 0 {
+		dir, binds, err := writeSecrets(c.secrets)
+		if err != nil {
+			return err
+		}
+		c.secretsDir = dir
+		var hc docker.HostConfig
+		if c.opt.HostConfig != nil {
+			hc = *c.opt.HostConfig
+		}
+		hc.Binds = append(append([]string(nil), hc.Binds...), binds...)
+		c.opt.HostConfig = &hc
+	}
 
 	container, err := d.Client.CreateContainer(c.opt)
 	if err != nil {
+		if _, err := c.cleanup(d); err != nil {
+			c.cleanupFailed(err)
+		}
 		return fmt.Errorf("dexec: failed to create container: %v", err)
 	}
 
+	c.mu.Lock()
 	c.id = container.ID
+	c.mu.Unlock()
 	return nil
 }
 
@@ -85,13 +354,63 @@ func (c *createContainer) run(d Docker, stdin io.Reader, stdout, stderr io.Write
 	if c.id == "" {
 		return errors.New("dexec: container is not created")
 	}
+	if c.onEvent != nil {
+		w, err := watchEvents(d, c.id, c.onEvent)
+		if err != nil {
+			if _, err := c.cleanup(d); err != nil {
+				c.cleanupFailed(err)
+			}
+			return err
+		}
+		c.events = w
+	}
 	if err := d.Client.StartContainer(c.id, nil); err != nil {
+		if _, err := c.cleanup(d); err != nil {
+			c.cleanupFailed(err)
+		}
 		return fmt.Errorf("dexec: failed to start container:  %v", err)
 	}
+	if c.ttySize != (TerminalSize{}) {
+		if err := c.resize(d, c.ttySize.Cols, c.ttySize.Rows); err != nil {
+			if _, err := c.cleanup(d); err != nil {
+				c.cleanupFailed(err)
+			}
+			return err
+		}
+	}
 
+	// Wait for the container to exit as early as possible, so that the exit
+	// code is captured even if the container is removed by someone else
+	// before Wait is called.
+	exited := make(chan waitResult, 1)
+	go func() {
+		ec, err := d.WaitContainer(c.id)
+		exited <- waitResult{ec, err}
+	}()
+	c.exited = exited
+	c.detached = make(chan struct{})
+
+	if c.noStdin {
+		stdin = nil
+	} else if c.stdinEOFTimeout > 0 {
+		id, t := c.id, &idleTimer{timeout: c.stdinEOFTimeout}
+		c.stdinEOF = t
+		stdin = &eofReader{r: stdin, fn: func() {
+			t.start(func() { c.stop(d, id) })
+		}}
+	}
+	if c.detachKeys != "" && stdin != nil {
+		c.detachRead = make(chan struct{})
+		stdin = &detachKeyReader{r: stdin, keys: detachKeyBytes(c.detachKeys), seen: c.detachRead}
+	}
+	if c.idleTimeout > 0 {
+		c.idle = &idleTimer{timeout: c.idleTimeout}
+		stdout = io.MultiWriter(c.idle, stdout)
+		stderr = io.MultiWriter(c.idle, stderr)
+	}
 	opts := docker.AttachToContainerOptions{
 		Container:    c.id,
-		Stdin:        true,
+		Stdin:        !c.noStdin,
 		Stdout:       true,
 		Stderr:       true,
 		InputStream:  stdin,
@@ -99,30 +418,454 @@ func (c *createContainer) run(d Docker, stdin io.Reader, stdout, stderr io.Write
 		ErrorStream:  stderr,
 		Stream:       true,
 		Logs:         true, // include produced output so far
+		DetachKeys:   c.detachKeys,
 	}
-	cw, err := d.Client.AttachToContainerNonBlocking(opts)
+	cw, err := c.attach(d, opts)
 	if err != nil {
-		return fmt.Errorf("dexec: failed to attach container: %v", err)
+		if _, err := c.cleanup(d); err != nil {
+			c.cleanupFailed(err)
+		}
+		return err
 	}
 	c.cw = cw
+	if c.idle != nil {
+		id := c.id
+		c.idle.start(func() {
+			d.KillContainer(docker.KillContainerOptions{ID: id, Signal: docker.SIGKILL})
+		})
+	}
 	return nil
 }
 
+// stopSeconds rounds a stop timeout up to whole seconds, as taken by Docker.
+func stopSeconds(timeout time.Duration) uint {
+	return uint((timeout + time.Second - 1) / time.Second)
+}
+
+// eofReader calls fn once when r reaches EOF.
+type eofReader struct {
+	r    io.Reader
+	fn   func()
+	once sync.Once
+}
+
+func (r *eofReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		r.once.Do(r.fn)
+	}
+	return n, err
+}
+
+// detachKeyReader closes seen once keys are read from r consecutively.
+type detachKeyReader struct {
+	r    io.Reader
+	keys []byte
+	n    int // number of keys matched so far
+	once sync.Once
+	seen chan struct{}
+}
+
+func (r *detachKeyReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	for _, b := range p[:n] {
+		if b != r.keys[r.n] {
+			r.n = 0
+		}
+		if b == r.keys[r.n] {
+			r.n++
+		}
+		if r.n == len(r.keys) {
+			r.once.Do(func() { close(r.seen) })
+			r.n = 0
+		}
+	}
+	return n, err
+}
+
+// attach attaches to the container, giving up after attachTimeout if set. On
+// timeout, the caller removes the container, which also unblocks the pending
+// attach, and an attach that succeeds anyway is closed.
+func (c *createContainer) attach(d Docker, opts docker.AttachToContainerOptions) (docker.CloseWaiter, error) {
+	type result struct {
+		cw  docker.CloseWaiter
+		err error
+	}
+	ch := make(chan result)
+	gaveUp := make(chan struct{})
+	go func() {
+		cw, err := d.Client.AttachToContainerNonBlocking(opts)
+		select {
+		case ch <- result{cw, err}:
+		case <-gaveUp:
+			if err == nil {
+				cw.Close()
+			}
+		}
+	}()
+
+	var timeout <-chan time.Time
+	if c.attachTimeout > 0 {
+		timeout = time.After(c.attachTimeout)
+	}
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return nil, fmt.Errorf("dexec: failed to attach container: %v", r.err)
+		}
+		return r.cw, nil
+	case <-timeout:
+		close(gaveUp)
+		return nil, fmt.Errorf("dexec: timed out attaching container after %v", c.attachTimeout)
+	}
+}
+
 func (c *createContainer) wait(d Docker) (exitCode int, err error) {
-	del := func() error { return d.RemoveContainer(docker.RemoveContainerOptions{ID: c.id, Force: true}) }
-	defer del()
+	handled := false // container is retained or removed below
+	defer func() {
+		if !handled {
+			if _, err := c.cleanup(d); err != nil {
+				c.cleanupFailed(err)
+			}
+		}
+	}()
 	if c.cw == nil {
 		return -1, errors.New("dexec: container is not attached")
 	}
-	if err = c.cw.Wait(); err != nil {
+	err = c.cw.Wait()
+	idled := c.idle != nil && c.idle.stop()
+	if c.stdinEOF != nil {
+		defer c.stdinEOF.stop() // the command no longer needs stopping
+	}
+	if c.isDetached() {
+		handled = true
+		c.stopEvents(d, false)
+		return -1, ErrDetached
+	}
+	if err != nil {
 		return -1, fmt.Errorf("dexec: attach error: %v", err)
 	}
-	ec, err := d.WaitContainer(c.id)
+	var res waitResult
+	exited := false
+	if c.detachKeysRead() {
+		// The stream also ends if the detach keys are read from stdin, in
+		// which case the container keeps running. Only checked if the
+		// keys were read, as Docker may also ignore them, and other
+		// commands may legitimately keep running briefly after closing
+		// their output.
+		select {
+		case res = <-c.exited:
+			exited = true
+		case <-time.After(detachGracePeriod):
+			if ct, err := d.InspectContainer(c.id); err == nil && ct.State.Running {
+				c.detachOnce.Do(func() { close(c.detached) })
+			}
+		}
+	}
+	if !exited {
+		select {
+		case res = <-c.exited:
+		case <-c.detached:
+			handled = true
+			c.stopEvents(d, false)
+			return -1, ErrDetached
+		}
+	}
+	if res.err != nil {
+		if _, ok := res.err.(*docker.NoSuchContainer); ok {
+			c.setRemoved()
+			return -1, errors.New("dexec: container was removed before its exit code was read")
+		}
+		return -1, fmt.Errorf("dexec: cannot wait for container: %v", res.err)
+	}
+	c.stopEvents(d, true)
+	killed := c.wasKilled()
+	c.captureState(d)
+	handled = true
+	if c.keep || c.keepKilled && (idled || killed) {
+		log.Printf("dexec: retaining container %s", c.id)
+	} else if _, err := c.cleanup(d); err != nil {
+		return -1, err
+	}
+	if idled {
+		return -1, ErrIdleTimeout
+	}
+	if killed {
+		return -1, ErrKilled
+	}
+	return res.exitCode, nil
+}
+
+func (c *createContainer) containerID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.id
+}
+
+func (c *createContainer) inspect(d Docker) (ContainerInfo, error) {
+	if c.id == "" {
+		return ContainerInfo{}, errors.New("dexec: container is not created")
+	}
+	ct, err := d.InspectContainer(c.id)
+	if err != nil {
+		return ContainerInfo{}, fmt.Errorf("dexec: failed to inspect container: %v", err)
+	}
+	info := ContainerInfo{
+		ID:        ct.ID,
+		State:     containerState(ct.State),
+		Health:    ct.State.Health.Status,
+		Pid:       ct.State.Pid,
+		StartedAt: ct.State.StartedAt,
+	}
+	if ns := ct.NetworkSettings; ns != nil {
+		info.IPAddress = ns.IPAddress
+		if len(ns.Ports) > 0 {
+			info.Ports = make(map[string][]string, len(ns.Ports))
+			for p, bindings := range ns.Ports {
+				addrs := []string{}
+				for _, b := range bindings {
+					addrs = append(addrs, net.JoinHostPort(b.HostIP, b.HostPort))
+				}
+				info.Ports[string(p)] = addrs
+			}
+		}
+	}
+	return info, nil
+}
+
+// captureState records the final state of the exited container, so that it
+// is available after the container is removed.
+func (c *createContainer) captureState(d Docker) {
+	ct, err := d.InspectContainer(c.id)
+	if err != nil {
+		c.finalErr = fmt.Errorf("dexec: failed to inspect container: %v", err)
+		return
+	}
+	c.final = &State{
+		ExitCode:   ct.State.ExitCode,
+		Error:      ct.State.Error,
+		OOMKilled:  ct.State.OOMKilled,
+		StartedAt:  ct.State.StartedAt,
+		FinishedAt: ct.State.FinishedAt,
+	}
+}
+
+func (c *createContainer) finalState() (State, error) {
+	if c.finalErr != nil {
+		return State{}, c.finalErr
+	}
+	if c.final == nil {
+		return State{}, errors.New("dexec: container has not exited")
+	}
+	return *c.final, nil
+}
+
+// signal sends sig to the container. It may be called concurrently with the
+// other methods, such as while wait blocks.
+func (c *createContainer) signal(d Docker, sig syscall.Signal) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.id == "" || c.removed {
+		return errNotRunning
+	}
+	err := d.KillContainer(docker.KillContainerOptions{ID: c.id, Signal: docker.Signal(sig)})
+	switch err.(type) {
+	case nil:
+		return nil
+	case *docker.ContainerNotRunning, *docker.NoSuchContainer:
+		return errNotRunning
+	}
+	return fmt.Errorf("dexec: failed to signal container: %v", err)
+}
+
+// kill kills the container. It may be called concurrently with the other
+// methods, such as while wait blocks.
+func (c *createContainer) kill(d Docker) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.id == "" {
+		return errNotRunning
+	}
+	c.killed = true
+	err := d.KillContainer(docker.KillContainerOptions{ID: c.id, Signal: docker.SIGKILL})
+	switch err.(type) {
+	case nil:
+		return nil
+	case *docker.ContainerNotRunning, *docker.NoSuchContainer:
+		err = errNotRunning
+	default:
+		err = fmt.Errorf("dexec: failed to kill container: %v", err)
+	}
+	c.killed = false
+	return err
+}
+
+func (c *createContainer) wasKilled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.killed
+}
+
+func (c *createContainer) isRemoved() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.removed
+}
+
+func (c *createContainer) setRemoved() {
+	c.mu.Lock()
+	c.removed = true
+	c.mu.Unlock()
+}
+
+// resize resizes the terminal of the container. It may be called
+// concurrently with the other methods, such as while wait blocks.
+func (c *createContainer) resize(d Docker, cols, rows uint16) error {
+	if !c.opt.Config.Tty {
+		return errors.New("dexec: command has no terminal")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.id == "" || c.removed {
+		return errNotRunning
+	}
+	if err := d.ResizeContainerTTY(c.id, int(rows), int(cols)); err != nil {
+		return fmt.Errorf("dexec: failed to resize terminal: %v", err)
+	}
+	return nil
+}
+
+func (c *createContainer) changes(d Docker) ([]FileChange, error) {
+	if c.id == "" {
+		return nil, errors.New("dexec: container is not created")
+	}
+	if c.isRemoved() {
+		return nil, errors.New("dexec: container is removed")
+	}
+	l, err := d.ContainerChanges(c.id)
 	if err != nil {
-		return -1, fmt.Errorf("dexec: cannot wait for container: %v", err)
+		return nil, fmt.Errorf("dexec: failed to get container changes: %v", err)
 	}
-	if err := del(); err != nil {
-		return -1, fmt.Errorf("dexec: error deleting container: %v", err)
+	changes := make([]FileChange, len(l))
+	for i, ch := range l {
+		changes[i] = FileChange{Path: ch.Path, Kind: ChangeKind(ch.Kind)}
+	}
+	return changes, nil
+}
+
+func containerState(s docker.State) string {
+	switch {
+	case s.Restarting:
+		return "restarting"
+	case s.Paused:
+		return "paused"
+	case s.Running:
+		return "running"
+	case s.StartedAt.IsZero():
+		return "created"
+	}
+	return "exited"
+}
+
+func (c *createContainer) detach(d Docker) error {
+	if c.cw == nil {
+		return errors.New("dexec: container is not attached")
+	}
+	c.detachOnce.Do(func() { close(c.detached) })
+	return c.cw.Close()
+}
+
+// detachKeysRead reports whether the detach keys were read from stdin.
+func (c *createContainer) detachKeysRead() bool {
+	if c.detachRead == nil {
+		return false
+	}
+	select {
+	case <-c.detachRead:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *createContainer) isDetached() bool {
+	select {
+	case <-c.detached:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopEvents stops passing events to onEvent, after the "die" event if waitDie
+// is set.
+func (c *createContainer) stopEvents(d Docker, waitDie bool) {
+	if c.events != nil {
+		c.events.stop(d, waitDie)
+		c.events = nil
+	}
+}
+
+// cleanupFailed reports a cleanup error that cannot be returned to the caller.
+func (c *createContainer) cleanupFailed(err error) {
+	if c.onCleanupError != nil {
+		c.onCleanupError(c.id, err)
+		return
+	}
+	log.Printf("dexec: failed to clean up container %s: %v", c.id, err)
+}
+
+func (c *createContainer) cleanup(d Docker) (CleanupOutcome, error) {
+	c.stopEvents(d, false)
+	res, err := c.removeContainer(d)
+	// secrets are removed even if the container is not, to keep them on the
+	// host no longer than necessary
+	if serr := removeSecrets(c.secretsDir); serr == nil {
+		c.secretsDir = ""
+	} else if err == nil {
+		err = serr
+	}
+	return res, err
+}
+
+// stop sends the stop signal to the container if it is still running, and
+// kills it if it does not exit within stopTimeout. Each step is logged, as is
+// an error, since stopping is best effort.
+func (c *createContainer) stop(d Docker, id string) {
+	if ct, err := d.InspectContainer(id); err == nil && !ct.State.Running {
+		return
+	}
+	log.Printf("dexec: stopping container %s", id)
+	start := time.Now()
+	err := d.StopContainer(id, stopSeconds(c.stopTimeout))
+	switch err.(type) {
+	case nil:
+		if time.Since(start) >= c.stopTimeout {
+			log.Printf("dexec: killed container %s after it did not stop within %v", id, c.stopTimeout)
+		}
+	case *docker.ContainerNotRunning, *docker.NoSuchContainer:
+		// exited or removed in the meantime
+	default:
+		log.Printf("dexec: failed to stop container %s: %v", id, err)
+	}
+}
+
+func (c *createContainer) removeContainer(d Docker) (CleanupOutcome, error) {
+	if c.id == "" || c.isRemoved() {
+		return CleanupAlreadyGone, nil
+	}
+	if c.stopTimeout > 0 {
+		// Removal below kills the container anyway if stopping fails.
+		c.stop(d, c.id)
+	}
+	res := CleanupRemoved
+	err := d.RemoveContainer(docker.RemoveContainerOptions{ID: c.id, Force: true})
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		res, err = CleanupAlreadyGone, nil // already removed by someone else
+	}
+	if err != nil {
+		return CleanupFailed, fmt.Errorf("dexec: error deleting container: %v", err)
 	}
-	return ec, nil
+	c.setRemoved()
+	return res, nil
 }
@@ -0,0 +1,340 @@
+package dexec
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	dockertest "github.com/fsouza/go-dockerclient/testing"
+)
+
+// fakeDocker starts the in-memory Docker server of go-dockerclient with the
+// busybox image. The caller must stop the server.
+func fakeDocker(t *testing.T) (Docker, *dockertest.DockerServer) {
+	srv, err := dockertest.NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := docker.NewClient(srv.URL())
+	if err != nil {
+		srv.Stop()
+		t.Fatal(err)
+	}
+	if err := cl.PullImage(docker.PullImageOptions{Repository: "busybox"}, docker.AuthConfiguration{}); err != nil {
+		srv.Stop()
+		t.Fatal(err)
+	}
+	return Docker{cl}, srv
+}
+
+func TestRemoveContainerFailed(t *testing.T) {
+	// nothing listens on the port, so removal fails
+	cl, err := docker.NewClient("tcp://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &createContainer{id: "dexec-test"}
+	res, err := c.removeContainer(Docker{cl})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if res != CleanupFailed {
+		t.Errorf("outcome = %v, want %v", res, CleanupFailed)
+	}
+	if c.removed {
+		t.Error("container is marked as removed")
+	}
+}
+
+func TestRemoveContainerAlreadyGone(t *testing.T) {
+	c := &createContainer{id: "dexec-test", removed: true}
+	res, err := c.removeContainer(Docker{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != CleanupAlreadyGone {
+		t.Errorf("outcome = %v, want %v", res, CleanupAlreadyGone)
+	}
+}
+
+func TestOnCleanupError(t *testing.T) {
+	d, srv := fakeDocker(t)
+	defer srv.Stop()
+	// fail starting the container, then removing it
+	srv.CustomHandler("^/containers/[^/]+(/start)?$", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" || strings.HasSuffix(r.URL.Path, "/start") {
+			http.Error(w, "injected failure", http.StatusInternalServerError)
+			return
+		}
+		srv.DefaultHandler().ServeHTTP(w, r)
+	}))
+
+	e, err := ByCreatingContainer(docker.CreateContainerOptions{Config: &docker.Config{Image: "busybox"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := d.Command(e, "true")
+	var ids []string
+	var errs []error
+	cmd.OnCleanupError = func(containerID string, err error) {
+		ids = append(ids, containerID)
+		errs = append(errs, err)
+	}
+	if err := cmd.Run(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(ids) != 1 {
+		t.Fatalf("OnCleanupError called %d times, want 1", len(ids))
+	}
+	cs, err := d.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 1 || ids[0] != cs[0].ID {
+		t.Errorf("OnCleanupError got container %q, want the one of %v", ids[0], cs)
+	}
+	if !strings.Contains(errs[0].Error(), "injected failure") {
+		t.Errorf("OnCleanupError got error %v", errs[0])
+	}
+}
+
+func TestRemoveExitedContainer(t *testing.T) {
+	d, srv := fakeDocker(t)
+	defer srv.Stop()
+	var stops int32
+	srv.CustomHandler("/containers/.*/stop", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&stops, 1)
+		srv.DefaultHandler().ServeHTTP(w, r)
+	}))
+
+	ct, err := d.CreateContainer(docker.CreateContainerOptions{Config: &docker.Config{Image: "busybox"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.MutateContainer(ct.ID, docker.State{ExitCode: 0}); err != nil {
+		t.Fatal(err)
+	}
+	c := &createContainer{id: ct.ID, stopTimeout: time.Second}
+	res, err := c.removeContainer(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != CleanupRemoved {
+		t.Errorf("outcome = %v, want %v", res, CleanupRemoved)
+	}
+	if n := atomic.LoadInt32(&stops); n != 0 {
+		t.Errorf("exited container stopped %d times", n)
+	}
+}
+
+// slowDialer dials only once release is closed, like a daemon that is slow to
+// accept connections for attaching, and closes closed when the connection is
+// closed.
+type slowDialer struct {
+	release chan struct{}
+	closed  chan struct{}
+}
+
+func (d slowDialer) Dial(network, address string) (net.Conn, error) {
+	<-d.release
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &notifyConn{TCPConn: conn.(*net.TCPConn), closed: d.closed}, nil
+}
+
+type notifyConn struct {
+	*net.TCPConn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *notifyConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.TCPConn.Close()
+}
+
+func TestAttachTimeout(t *testing.T) {
+	d, srv := fakeDocker(t)
+	defer srv.Stop()
+	dialer := slowDialer{release: make(chan struct{}), closed: make(chan struct{})}
+	d.Dialer = dialer // only used to attach
+	done := make(chan struct{})
+	defer close(done)
+	srv.CustomHandler("/containers/.*/attach", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// attach successfully, with the stream kept open until the test ends
+		w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		<-done
+	}))
+
+	e, err := ByCreatingContainer(docker.CreateContainerOptions{Config: &docker.Config{Image: "busybox"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := d.Command(e, "true")
+	cmd.AttachTimeout = 100 * time.Millisecond
+	if err, want := cmd.Start(), "dexec: timed out attaching container after 100ms"; err == nil || err.Error() != want {
+		t.Fatalf("Start() = %v, want %q", err, want)
+	}
+	l, err := d.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 0 {
+		t.Errorf("%d containers left, want none", len(l))
+	}
+
+	// the attach completing after the timeout is closed
+	close(dialer.release)
+	select {
+	case <-dialer.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("late attach is not closed")
+	}
+}
+
+func TestConcurrentControl(t *testing.T) {
+	d, srv := fakeDocker(t)
+	defer srv.Stop()
+
+	e, err := ByCreatingContainer(docker.CreateContainerOptions{Config: &docker.Config{Image: "busybox", Tty: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := d.Command(e, "sh")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Errors are expected once the command exits; only the races matter,
+	// which go test -race reports.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, fn := range []func() error{
+		func() error { return cmd.Signal(syscall.SIGHUP) },
+		func() error { return cmd.Resize(80, 24) },
+		func() error { return cmd.Kill() },
+	} {
+		wg.Add(1)
+		go func(fn func() error) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					fn()
+				}
+			}
+		}(fn)
+	}
+	err = cmd.Wait()
+	close(done)
+	wg.Wait()
+	// the fake server stops the container for any signal
+	if err != nil && err != ErrKilled {
+		t.Fatalf("Wait() = %v", err)
+	}
+}
+
+func TestConcurrentRun(t *testing.T) {
+	d, srv := fakeDocker(t)
+	defer srv.Stop()
+	// containers of the fake server run until stopped, so exit right away
+	srv.CustomHandler("/containers/.*/start", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.DefaultHandler().ServeHTTP(w, r)
+		id := strings.Split(r.URL.Path, "/")[2]
+		srv.MutateContainer(id, docker.State{StartedAt: time.Now(), ExitCode: 0})
+	}))
+
+	run := func() error {
+		e, err := ByCreatingContainer(docker.CreateContainerOptions{Config: &docker.Config{Image: "busybox"}})
+		if err != nil {
+			return err
+		}
+		return d.Command(e, "true").Run()
+	}
+	// go-dockerclient looks up the server version on the first start
+	// without locking, so do that before running concurrently
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 20
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() { errs <- run() }()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	cs, err := d.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 0 {
+		t.Errorf("%d containers left", len(cs))
+	}
+}
+
+func TestDetachKeyReader(t *testing.T) {
+	tests := []struct {
+		in   []string // successive reads
+		seen bool
+	}{
+		{[]string{"ls\n"}, false},
+		{[]string{"\x10\x11"}, true},
+		{[]string{"a\x10", "\x11b"}, true},
+		{[]string{"\x10\x10\x11"}, true},
+		{[]string{"\x10a\x11"}, false},
+		{[]string{"\x11\x10"}, false},
+	}
+	for _, tt := range tests {
+		seen := make(chan struct{})
+		r := &detachKeyReader{r: &chunkReader{chunks: tt.in}, keys: detachKeyBytes("ctrl-p,ctrl-q"), seen: seen}
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-seen:
+			if !tt.seen {
+				t.Errorf("%q: detach keys seen", tt.in)
+			}
+		default:
+			if tt.seen {
+				t.Errorf("%q: detach keys not seen", tt.in)
+			}
+		}
+	}
+}
+
+// chunkReader returns each of chunks in a separate Read.
+type chunkReader struct {
+	chunks []string
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
@@ -1,18 +1,85 @@
 package dexec
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// maxSignal is the largest signal number considered when interpreting exit
+// codes as terminating signals.
+const maxSignal = 64
 
 // ExitError reports an unsuccessful exit by a command.
 type ExitError struct {
+	// Path and Args are the command that exited, as in Cmd.
+	Path string
+	Args []string
+
+	// ContainerID is the ID of the container the command ran in.
+	ContainerID string
+
 	// ExitCode holds the non-zero exit code of the container
 	ExitCode int
 
+	// Signaled is true if the exit code indicates the command was terminated
+	// by a signal, following the shell convention of 128+signal. Docker does
+	// not distinguish these from regular exit codes, so a command exiting
+	// with such a code by itself is reported as signaled as well.
+	Signaled bool
+
+	// Signal holds the terminating signal if Signaled is true.
+	Signal syscall.Signal
+
 	// Stderr holds the standard error output from the command
 	// if it *Cmd executed through Output() and Cmd.Stderr was not
-	// set.
+	// set. Otherwise, it holds the last Cmd.StderrTail bytes of
+	// standard error output if StderrTail is set.
 	Stderr []byte
 }
 
+func newExitError(path string, args []string, containerID string, code int) *ExitError {
+	e := &ExitError{Path: path, Args: args, ContainerID: containerID, ExitCode: code}
+	if code > 128 && code <= 128+maxSignal {
+		e.Signaled = true
+		e.Signal = syscall.Signal(code - 128)
+	}
+	return e
+}
+
 func (e *ExitError) Error() string {
-	return fmt.Sprintf("dexec: exit status: %d", e.ExitCode)
+	msg := fmt.Sprintf("exit status: %d", e.ExitCode)
+	if e.Signaled {
+		msg += fmt.Sprintf(" (signal: %v)", e.Signal)
+	}
+	var where []string
+	if e.Path != "" {
+		where = append(where, strconv.Quote(strings.Join(append([]string{e.Path}, e.Args...), " ")))
+	}
+	if e.ContainerID != "" {
+		where = append(where, "in container "+shortID(e.ContainerID))
+	}
+	if len(where) == 0 {
+		return "dexec: " + msg
+	}
+	return fmt.Sprintf("dexec: %s: %s", strings.Join(where, " "), msg)
+}
+
+// shortID abbreviates a container ID to 12 characters, as the docker CLI
+// displays it.
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// IsSignaled reports whether err is an *ExitError for a command terminated by
+// a signal, and returns the signal.
+func IsSignaled(err error) (syscall.Signal, bool) {
+	if ee, ok := err.(*ExitError); ok && ee.Signaled {
+		return ee.Signal, true
+	}
+	return 0, false
 }
@@ -0,0 +1,20 @@
+package dexec
+
+import "testing"
+
+func TestExitErrorMessage(t *testing.T) {
+	id := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	for _, tt := range []struct {
+		err  *ExitError
+		want string
+	}{
+		{newExitError("sh", []string{"-c", "exit 3"}, id, 3), `dexec: "sh -c exit 3" in container 0123456789ab: exit status: 3`},
+		{newExitError("sleep", []string{"10"}, id, 137), `dexec: "sleep 10" in container 0123456789ab: exit status: 137 (signal: killed)`},
+		{newExitError("true", nil, "", 1), `dexec: "true": exit status: 1`},
+		{&ExitError{ExitCode: 2}, "dexec: exit status: 2"},
+	} {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("Error() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package dexec
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// digestRef matches image references pinned by a content digest, such as
+// "busybox@sha256:<hex>".
+var digestRef = regexp.MustCompile(`@[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}$`)
+
+// hasDigest reports whether image reference is pinned by a digest.
+func hasDigest(image string) bool { return digestRef.MatchString(image) }
+
+// validateDigest returns an error if image reference is not pinned by a
+// digest.
+func validateDigest(image string) error {
+	if !hasDigest(image) {
+		return fmt.Errorf("dexec: image %q is not pinned by digest (expected name@sha256:...)", image)
+	}
+	return nil
+}
+
+// archNames maps machine names reported by the Docker engine to the
+// architecture names used by images.
+var archNames = map[string]string{
+	"x86_64": "amd64", "i386": "386", "i686": "386",
+	"aarch64": "arm64", "armv7l": "arm", "armv6l": "arm",
+}
+
+func normalizeArch(arch string) string {
+	if a, ok := archNames[arch]; ok {
+		return a
+	}
+	return arch
+}
+
+// checkPlatform returns an error if image is built for a different OS or
+// architecture than the Docker engine, on which it would run under emulation
+// if at all. Images that are not present on the engine are not checked.
+func checkPlatform(d Docker, image string) error {
+	img, err := d.InspectImage(image)
+	if err == docker.ErrNoSuchImage {
+		return nil // creating the container will fail
+	} else if err != nil {
+		return fmt.Errorf("dexec: failed to inspect image: %v", err)
+	}
+	info, err := d.Info()
+	if err != nil {
+		return fmt.Errorf("dexec: failed to get Docker engine info: %v", err)
+	}
+	return platformMismatch(image, img.OS, img.Architecture, info.OSType, info.Architecture)
+}
+
+// platformMismatch compares the platform of an image to that of the engine.
+// Empty values are unknown and match any platform.
+func platformMismatch(image, imgOS, imgArch, engineOS, engineArch string) error {
+	imgArch, engineArch = normalizeArch(imgArch), normalizeArch(engineArch)
+	if (imgOS == "" || engineOS == "" || imgOS == engineOS) &&
+		(imgArch == "" || engineArch == "" || imgArch == engineArch) {
+		return nil
+	}
+	return fmt.Errorf("dexec: image %q is built for %s/%s, but the Docker engine runs on %s/%s",
+		image, imgOS, imgArch, engineOS, engineArch)
+}
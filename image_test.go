@@ -0,0 +1,51 @@
+package dexec
+
+import "testing"
+
+func TestValidateDigest(t *testing.T) {
+	const sum = "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+	for _, tt := range []struct {
+		image string
+		ok    bool
+	}{
+		{"busybox@" + sum, true},
+		{"docker.io/library/busybox@" + sum, true},
+		{"localhost:5000/busybox@" + sum, true},
+		{"busybox:latest@" + sum, true},
+		{"busybox", false},
+		{"busybox:latest", false},
+		{"localhost:5000/busybox:1.0", false},
+		{"busybox@sha256:", false},
+		{"busybox@sha256:xyz", false},
+		{"busybox@" + sum + "/foo", false},
+	} {
+		err := validateDigest(tt.image)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("validateDigest(%q) = %v; expected ok=%v", tt.image, err, tt.ok)
+		}
+	}
+}
+
+func TestPlatformMismatch(t *testing.T) {
+	for _, tt := range []struct {
+		imgOS, imgArch, engineOS, engineArch string
+		mismatch                             bool
+	}{
+		{"linux", "amd64", "linux", "x86_64", false},
+		{"linux", "arm64", "linux", "aarch64", false},
+		{"linux", "arm", "linux", "armv7l", false},
+		{"linux", "amd64", "linux", "amd64", false},
+		{"", "", "linux", "x86_64", false},
+		{"linux", "amd64", "", "", false},
+		{"linux", "amd64", "linux", "aarch64", true},
+		{"linux", "arm64", "linux", "x86_64", true},
+		{"windows", "amd64", "linux", "x86_64", true},
+		{"linux", "s390x", "linux", "ppc64le", true},
+	} {
+		err := platformMismatch("img", tt.imgOS, tt.imgArch, tt.engineOS, tt.engineArch)
+		if (err != nil) != tt.mismatch {
+			t.Errorf("%s/%s on %s/%s: got error %v; expected mismatch=%v",
+				tt.imgOS, tt.imgArch, tt.engineOS, tt.engineArch, err, tt.mismatch)
+		}
+	}
+}
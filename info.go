@@ -0,0 +1,76 @@
+package dexec
+
+import "time"
+
+// ContainerInfo describes the container executing a command.
+type ContainerInfo struct {
+	// ID is the ID of the container.
+	ID string
+
+	// IPAddress is the IP address assigned to the container, if any.
+	IPAddress string
+
+	// Ports maps exposed container ports (e.g. "80/tcp") to the host
+	// addresses (e.g. "0.0.0.0:32768") they are published on.
+	Ports map[string][]string
+
+	// State is the state of the container: "created", "running", "paused",
+	// "restarting" or "exited".
+	State string
+
+	// Health is the health status of the container, such as "starting",
+	// "healthy" or "unhealthy", if it has a health check.
+	Health string
+
+	// Pid is the process ID of the command on the host, or 0 if it is not
+	// running.
+	Pid int
+
+	// StartedAt is the time the container was started.
+	StartedAt time.Time
+}
+
+// State is the final state of the container that executed a command.
+type State struct {
+	// ExitCode is the exit code of the command.
+	ExitCode int
+
+	// Error is the error reported by Docker for the container, if any.
+	Error string
+
+	// OOMKilled is true if the command was killed for running out of memory.
+	OOMKilled bool
+
+	// StartedAt and FinishedAt are the times the container started and
+	// exited.
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// ChangeKind is the kind of a change to the container filesystem.
+type ChangeKind int
+
+// Kinds of changes to the container filesystem.
+const (
+	ChangeModified ChangeKind = iota
+	ChangeAdded
+	ChangeDeleted
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeModified:
+		return "modified"
+	case ChangeAdded:
+		return "added"
+	case ChangeDeleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// FileChange is a change to the container filesystem made by a command.
+type FileChange struct {
+	Path string
+	Kind ChangeKind
+}
@@ -0,0 +1,190 @@
+package dexec
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOutputTruncated is returned by Output, CombinedOutput and ExecuteAndWait
+// if the command produced more output than Cmd.MaxOutputBytes allows.
+var ErrOutputTruncated = errors.New("dexec: output truncated")
+
+// OutputLine is a line of output produced by a command.
+type OutputLine struct {
+	// Stream is the stream that the line is read from, "stdout" or "stderr".
+	Stream string
+
+	// Time is the time the line started to be received from the container.
+	Time time.Time
+
+	// Text is the line without the trailing newline.
+	Text string
+}
+
+// lineWriter splits the data written to it into lines and passes them to fn.
+type lineWriter struct {
+	stream string
+	fn     func(OutputLine)
+	mu     *sync.Mutex // shared between streams to call fn serially
+
+	buf []byte
+	t   time.Time // time of the first write to buf
+}
+
+func newLineWriters(fn func(OutputLine)) (stdout, stderr *lineWriter) {
+	mu := new(sync.Mutex)
+	return &lineWriter{stream: "stdout", fn: fn, mu: mu},
+		&lineWriter{stream: "stderr", fn: fn, mu: mu}
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	n := len(b)
+	for len(b) > 0 {
+		if len(w.buf) == 0 {
+			w.t = now
+		}
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			w.buf = append(w.buf, b...)
+			break
+		}
+		w.buf = append(w.buf, b[:i]...)
+		w.emit()
+		b = b[i+1:]
+	}
+	return n, nil
+}
+
+// flush passes the remaining data not terminated by a newline, if any.
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.emit()
+	}
+}
+
+func (w *lineWriter) emit() {
+	w.fn(OutputLine{Stream: w.stream, Time: w.t, Text: string(w.buf)})
+	w.buf = w.buf[:0]
+}
+
+// captureBuffer is a buffer for capturing output which discards data beyond
+// max bytes, if max is positive.
+type captureBuffer struct {
+	bytes.Buffer
+	max       int64
+	truncated bool
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if b.max > 0 {
+		if left := b.max - int64(b.Len()); int64(len(p)) > left {
+			p = p[:left]
+			b.truncated = true
+		}
+	}
+	b.Buffer.Write(p)
+	return n, nil
+}
+
+// tailBuffer retains the last bytes written to it, up to the size of buf.
+type tailBuffer struct {
+	buf  []byte
+	pos  int  // next position to write at
+	full bool // buf wrapped around
+}
+
+func newTailBuffer(n int) *tailBuffer {
+	return &tailBuffer{buf: make([]byte, n)}
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) >= len(b.buf) {
+		copy(b.buf, p[len(p)-len(b.buf):])
+		b.pos, b.full = 0, true
+		return n, nil
+	}
+	c := copy(b.buf[b.pos:], p)
+	if c < len(p) {
+		b.pos = copy(b.buf, p[c:])
+		b.full = true
+	} else {
+		b.pos += c
+	}
+	return n, nil
+}
+
+// Bytes returns a copy of the retained bytes in the order they were written.
+func (b *tailBuffer) Bytes() []byte {
+	if !b.full {
+		return append([]byte(nil), b.buf[:b.pos]...)
+	}
+	return append(append([]byte(nil), b.buf[b.pos:]...), b.buf[:b.pos]...)
+}
+
+// idleTimer calls a function once no output is written to it for a timeout,
+// counted from when it is started. Starting it after it is stopped, or more
+// than once, has no effect.
+type idleTimer struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	t       *time.Timer
+	fired   bool
+	stopped bool
+}
+
+func (i *idleTimer) start(fn func()) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.t != nil || i.stopped {
+		return
+	}
+	i.t = time.AfterFunc(i.timeout, func() {
+		i.mu.Lock()
+		i.fired = true
+		i.mu.Unlock()
+		fn()
+	})
+}
+
+func (i *idleTimer) Write(p []byte) (int, error) {
+	i.mu.Lock()
+	if i.t != nil && !i.fired {
+		i.t.Reset(i.timeout)
+	}
+	i.mu.Unlock()
+	return len(p), nil
+}
+
+// stop stops the timer and reports whether it fired.
+func (i *idleTimer) stop() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.stopped = true
+	if i.t != nil {
+		i.t.Stop()
+	}
+	return i.fired
+}
+
+// truncate returns ErrOutputTruncated in place of a nil err if any of bufs
+// discarded data.
+func truncate(err error, bufs ...*captureBuffer) error {
+	if err != nil {
+		return err
+	}
+	for _, b := range bufs {
+		if b.truncated {
+			return ErrOutputTruncated
+		}
+	}
+	return nil
+}
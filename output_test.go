@@ -0,0 +1,124 @@
+package dexec
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLineWriter(t *testing.T) {
+	var lines []OutputLine
+	stdout, stderr := newLineWriters(func(l OutputLine) {
+		if l.Time.IsZero() {
+			t.Errorf("line %q has no time", l.Text)
+		}
+		lines = append(lines, l)
+	})
+	stdout.Write([]byte("a\nb"))
+	stderr.Write([]byte("err\n"))
+	stdout.Write([]byte("c\n\nd"))
+	stdout.flush()
+	stderr.flush()
+
+	var got []string
+	for _, l := range lines {
+		got = append(got, l.Stream+":"+l.Text)
+	}
+	expected := []string{"stdout:a", "stderr:err", "stdout:bc", "stdout:", "stdout:d"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got lines %q; expected %q", got, expected)
+	}
+}
+
+func TestCaptureBuffer(t *testing.T) {
+	b := &captureBuffer{max: 5}
+	for _, s := range []string{"ab", "cd", "ef", "gh"} {
+		if n, err := b.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	if got := b.String(); got != "abcde" {
+		t.Fatalf("got %q; expected %q", got, "abcde")
+	}
+	if !b.truncated {
+		t.Fatal("expected truncated")
+	}
+	if err := truncate(nil, b); err != ErrOutputTruncated {
+		t.Fatalf("got error %v; expected ErrOutputTruncated", err)
+	}
+
+	b = &captureBuffer{max: 4}
+	b.Write([]byte("abcd"))
+	if b.truncated {
+		t.Fatal("not expected to be truncated at the limit")
+	}
+	if err := truncate(nil, b); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	b = &captureBuffer{}
+	b.Write(make([]byte, 1<<20))
+	if b.Len() != 1<<20 || b.truncated {
+		t.Fatal("not expected to be truncated without a limit")
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	for _, tt := range []struct {
+		writes []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{"ab"}, "ab"},
+		{[]string{"ab", "cd"}, "abcd"},
+		{[]string{"ab", "cd", "ef"}, "bcdef"},
+		{[]string{"abc", "defgh", "ij"}, "fghij"},
+		{[]string{"abcdefgh"}, "defgh"},
+		{[]string{"a", "bcdefgh", "i"}, "efghi"},
+	} {
+		b := newTailBuffer(5)
+		for _, s := range tt.writes {
+			if n, err := b.Write([]byte(s)); n != len(s) || err != nil {
+				t.Fatalf("Write(%q) = %d, %v", s, n, err)
+			}
+		}
+		if got := string(b.Bytes()); got != tt.want {
+			t.Errorf("after %q got %q; expected %q", tt.writes, got, tt.want)
+		}
+	}
+}
+
+func TestIdleTimer(t *testing.T) {
+	fired := make(chan struct{})
+	i := &idleTimer{timeout: 50 * time.Millisecond}
+	i.Write([]byte("before start")) // no-op
+	i.start(func() { close(fired) })
+	for n := 0; n < 5; n++ {
+		time.Sleep(20 * time.Millisecond)
+		i.Write([]byte("x"))
+	}
+	select {
+	case <-fired:
+		t.Fatal("fired while output was written")
+	default:
+	}
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("did not fire without output")
+	}
+	if !i.stop() {
+		t.Fatal("stop did not report firing")
+	}
+
+	i = &idleTimer{timeout: time.Hour}
+	i.start(func() {})
+	if i.stop() {
+		t.Fatal("stop reported firing")
+	}
+
+	i = &idleTimer{timeout: time.Millisecond}
+	i.stop()
+	i.start(func() { t.Error("fired after stop") })
+	time.Sleep(20 * time.Millisecond)
+}
@@ -0,0 +1,49 @@
+package dexec
+
+import "time"
+
+// Result holds the outcome of a command run by ExecuteAndWait.
+type Result struct {
+	// Stdout and Stderr hold the standard output and error of the command.
+	Stdout []byte
+	Stderr []byte
+
+	// ExitCode is the exit code of the command.
+	ExitCode int
+
+	// Duration is the time it took to start the command and wait for it to
+	// complete.
+	Duration time.Duration
+}
+
+// ExecuteAndWait runs the command and returns its standard output, standard
+// error and exit code.
+//
+// Different than Run and Output, the error is nil if the command exits with
+// a non-zero exit code, which is reported in Result.ExitCode instead. The
+// error is reserved for failures to create, run or clean up the container,
+// and for output exceeding Cmd.MaxOutputBytes.
+func (c *Cmd) ExecuteAndWait() (Result, error) {
+	if err := c.configureStream("Stdout", "ExecuteAndWait", streamCapture); err != nil {
+		return Result{}, err
+	}
+	if err := c.configureStream("Stderr", "ExecuteAndWait", streamCapture); err != nil {
+		return Result{}, err
+	}
+	stdout := &captureBuffer{max: c.MaxOutputBytes}
+	stderr := &captureBuffer{max: c.MaxOutputBytes}
+	c.Stdout, c.Stderr = stdout, stderr
+
+	start := time.Now()
+	err := c.Run()
+	r := Result{
+		Stdout:   stdout.Bytes(),
+		Stderr:   stderr.Bytes(),
+		Duration: time.Since(start),
+	}
+	if ee, ok := err.(*ExitError); ok {
+		r.ExitCode = ee.ExitCode
+		err = nil
+	}
+	return r, truncate(err, stdout, stderr)
+}
@@ -0,0 +1,100 @@
+package dexec
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Secret is a file made available to the command without placing its contents
+// in the image, the container configuration or the environment.
+type Secret struct {
+	// Target is the absolute path of the file in the container. It must not
+	// contain ':' or ',', which Docker does not accept in bind paths.
+	Target string
+
+	// Data is the contents of the file.
+	Data []byte
+
+	// Mode holds the permission bits of the file. If Mode is zero, 0400 is
+	// used. Other bits, such as setuid, are rejected. The file is owned by
+	// the user running the current process.
+	Mode os.FileMode
+}
+
+// secretsDir returns the directory to write secrets to, preferring a memory
+// backed file system.
+func secretsDir() string {
+	if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+		return "/dev/shm"
+	}
+	return os.TempDir()
+}
+
+// validateSecrets checks that secret targets are distinct absolute file
+// paths which can be written in a bind, which separates fields with ":" and
+// options with ",".
+func validateSecrets(secrets []Secret) error {
+	seen := make(map[string]bool, len(secrets))
+	for _, s := range secrets {
+		if !path.IsAbs(s.Target) {
+			return fmt.Errorf("dexec: secret target must be an absolute path: %q", s.Target)
+		}
+		if strings.ContainsAny(s.Target, ":,") {
+			return fmt.Errorf("dexec: secret target must not contain ':' or ',': %q", s.Target)
+		}
+		if s.Mode&^os.ModePerm != 0 {
+			return fmt.Errorf("dexec: secret %q: mode %v has bits other than permissions", s.Target, s.Mode)
+		}
+		target := path.Clean(s.Target)
+		if target == "/" {
+			return fmt.Errorf("dexec: secret target must be a file path: %q", s.Target)
+		}
+		if seen[target] {
+			return fmt.Errorf("dexec: duplicate secret target: %q", s.Target)
+		}
+		seen[target] = true
+	}
+	return nil
+}
+
+// writeSecrets writes secrets to files in a new directory readable only by
+// the current user and returns the directory along with read-only binds of
+// the files to their targets.
+func writeSecrets(secrets []Secret) (dir string, binds []string, err error) {
+	dir, err = ioutil.TempDir(secretsDir(), "dexec-secrets-")
+	if err != nil {
+		return "", nil, fmt.Errorf("dexec: failed to create secrets directory: %v", err)
+	}
+	for i, s := range secrets {
+		mode := s.Mode
+		if mode == 0 {
+			mode = 0400
+		}
+		f := filepath.Join(dir, strconv.Itoa(i))
+		if err := ioutil.WriteFile(f, s.Data, 0600); err == nil {
+			err = os.Chmod(f, mode)
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", nil, fmt.Errorf("dexec: failed to write secret %q: %v", s.Target, err)
+		}
+		binds = append(binds, f+":"+path.Clean(s.Target)+":ro")
+	}
+	return dir, binds, nil
+}
+
+func removeSecrets(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.New("dexec: failed to remove secrets: " + err.Error())
+	}
+	return nil
+}
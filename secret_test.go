@@ -0,0 +1,93 @@
+package dexec
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidateSecrets(t *testing.T) {
+	for _, tt := range []struct {
+		targets []string
+		err     string
+	}{
+		{[]string{"/a", "/b/c"}, ""},
+		{[]string{"a"}, "must be an absolute path"},
+		{[]string{"/a", "/a"}, "duplicate secret target"},
+		{[]string{"/a", "/b/../a/"}, "duplicate secret target"},
+		{[]string{"/a:/b"}, "must not contain ':' or ','"},
+		{[]string{"/a,rw"}, "must not contain ':' or ','"},
+		{[]string{"/run/../"}, "must be a file path"},
+	} {
+		var secrets []Secret
+		for _, p := range tt.targets {
+			secrets = append(secrets, Secret{Target: p})
+		}
+		err := validateSecrets(secrets)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("validateSecrets(%v) = %v, want error containing %q", tt.targets, err, tt.err)
+		}
+	}
+}
+
+func TestValidateSecretsMode(t *testing.T) {
+	for _, mode := range []os.FileMode{0, 0400, 0644} {
+		if err := validateSecrets([]Secret{{Target: "/a", Mode: mode}}); err != nil {
+			t.Errorf("mode %v: %v", mode, err)
+		}
+	}
+	for _, mode := range []os.FileMode{os.ModeSetuid | 0755, os.ModeSetgid | 0400, os.ModeSticky | 0400, os.ModeDir | 0700} {
+		if err := validateSecrets([]Secret{{Target: "/a", Mode: mode}}); err == nil {
+			t.Errorf("mode %v: no error", mode)
+		}
+	}
+}
+
+func TestWriteSecrets(t *testing.T) {
+	dir, binds, err := writeSecrets([]Secret{
+		{Target: "/run/a", Data: []byte("foo")},
+		{Target: "/run/b", Data: []byte("bar"), Mode: 0444},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if fi, err := os.Stat(dir); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0700 {
+		t.Fatalf("secrets directory mode = %v, want 0700", fi.Mode().Perm())
+	}
+	if len(binds) != 2 {
+		t.Fatalf("got %d binds, want 2", len(binds))
+	}
+	for i, want := range []struct {
+		target, data string
+		mode         os.FileMode
+	}{
+		{"/run/a", "foo", 0400},
+		{"/run/b", "bar", 0444},
+	} {
+		parts := strings.Split(binds[i], ":")
+		if len(parts) != 3 || parts[1] != want.target || parts[2] != "ro" {
+			t.Fatalf("bind %d = %q", i, binds[i])
+		}
+		b, err := ioutil.ReadFile(parts[0])
+		if err != nil || string(b) != want.data {
+			t.Errorf("secret %s = %q, %v; want %q", want.target, b, err, want.data)
+		}
+		if fi, err := os.Stat(parts[0]); err != nil {
+			t.Error(err)
+		} else if fi.Mode().Perm() != want.mode {
+			t.Errorf("secret %s mode = %v, want %v", want.target, fi.Mode().Perm(), want.mode)
+		}
+	}
+
+	if err := removeSecrets(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("secrets directory not removed: %v", err)
+	}
+}
@@ -0,0 +1,319 @@
+package dexec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// sessionIdleCmd keeps a session container running between commands.
+var sessionIdleCmd = []string{DefaultShell, "-c", "while :; do sleep 3600; done"}
+
+// execPollInterval is how often Wait checks whether a command run in a
+// Session has exited after its streams end.
+const execPollInterval = 50 * time.Millisecond
+
+// Session is a container in which multiple commands run, such as the setup,
+// main and teardown steps of a job. The commands share the filesystem and
+// the environment of the container, which is created once by NewSession and
+// removed by Close.
+type Session struct {
+	d  Docker
+	id string
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewSession creates and starts a container with the specified options for
+// running commands with Session.Command. The options are validated like by
+// ByCreatingContainer.
+//
+// Unless Config.Entrypoint or Config.Cmd is set, the container runs an idle
+// loop of DefaultShell, which the image must provide, to keep it running
+// between commands. The caller must call Close to remove the container.
+func (d Docker) NewSession(opts docker.CreateContainerOptions) (*Session, error) {
+	if d.Client == nil {
+		return nil, ErrNilClient
+	}
+	if err := validateOptions(opts); err != nil {
+		return nil, err
+	}
+	cfg := *opts.Config
+	if len(cfg.Entrypoint) == 0 && len(cfg.Cmd) == 0 {
+		cfg.Entrypoint = sessionIdleCmd
+	}
+	opts.Config = &cfg
+
+	ct, err := d.CreateContainer(opts)
+	if err != nil {
+		return nil, fmt.Errorf("dexec: failed to create container: %v", err)
+	}
+	s := &Session{d: d, id: ct.ID}
+	if err := d.StartContainer(s.id, nil); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("dexec: failed to start container: %v", err)
+	}
+	return s, nil
+}
+
+// ID returns the ID of the container of the session.
+func (s *Session) ID() string { return s.id }
+
+// Command returns the Cmd struct to execute the named program with given
+// arguments in the container of the session. Commands can run one after
+// another or concurrently, and are not affected by each other exiting.
+//
+// Settings of Cmd that concern the container rather than the command, such
+// as KeepContainer, Secrets or StopTimeout, and methods like Signal, Kill and
+// Inspect, are not supported and return an error. Therefore closing the
+// reader of CombinedOutputReader returns an error too, rather than killing
+// the command. Cleanup does nothing, as the container is removed by Close,
+// and CleanupWithOutcome reports CleanupAlreadyGone.
+func (s *Session) Command(name string, arg ...string) *Cmd {
+	return s.d.Command(&execInSession{s: s}, name, arg...)
+}
+
+// Close removes the container of the session, killing any commands still
+// running in it. Calling Close more than once is safe.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	err := s.d.RemoveContainer(docker.RemoveContainerOptions{ID: s.id, Force: true})
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		err = nil // already removed by someone else
+	}
+	if err != nil {
+		return fmt.Errorf("dexec: error deleting container: %v", err)
+	}
+	s.closed = true
+	return nil
+}
+
+// execInSession is the execution strategy of Session commands, which run as
+// execs in the container of the session.
+type execInSession struct {
+	unsupportedInSession
+
+	s       *Session
+	env     []string
+	dir     string
+	noStdin bool
+
+	id string // exec id
+	cw docker.CloseWaiter
+
+	detachOnce sync.Once
+	detached   chan struct{} // closed on detach
+}
+
+func (e *execInSession) create(d Docker, cmd []string) error {
+	if argsTooLong(cmd, e.env) {
+		return ErrArgListTooLong
+	}
+	exec, err := d.CreateExec(docker.CreateExecOptions{
+		Container:    e.s.id,
+		Cmd:          cmd,
+		Env:          e.env,
+		WorkingDir:   e.dir,
+		AttachStdin:  !e.noStdin,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return fmt.Errorf("dexec: failed to create exec: %v", err)
+	}
+	e.id = exec.ID
+	return nil
+}
+
+func (e *execInSession) run(d Docker, stdin io.Reader, stdout, stderr io.Writer) error {
+	if e.id == "" {
+		return errors.New("dexec: exec is not created")
+	}
+	if e.noStdin {
+		stdin = nil
+	}
+	e.detached = make(chan struct{})
+	cw, err := d.StartExecNonBlocking(e.id, docker.StartExecOptions{
+		InputStream:  stdin,
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+	})
+	if err != nil {
+		return fmt.Errorf("dexec: failed to start exec: %v", err)
+	}
+	e.cw = cw
+	return nil
+}
+
+func (e *execInSession) wait(d Docker) (int, error) {
+	if e.cw == nil {
+		return -1, errors.New("dexec: exec is not started")
+	}
+	err := e.cw.Wait()
+	if e.isDetached() {
+		return -1, ErrDetached
+	}
+	if err != nil {
+		return -1, fmt.Errorf("dexec: attach error: %v", err)
+	}
+	// the streams may end slightly before the exit code is recorded
+	for {
+		ins, err := d.InspectExec(e.id)
+		if err != nil {
+			return -1, fmt.Errorf("dexec: failed to inspect exec: %v", err)
+		}
+		if !ins.Running {
+			return ins.ExitCode, nil
+		}
+		time.Sleep(execPollInterval)
+	}
+}
+
+func (e *execInSession) containerID() string { return e.s.id }
+
+func (e *execInSession) cleanup(d Docker) (CleanupOutcome, error) {
+	return CleanupAlreadyGone, nil // the container belongs to the session
+}
+
+func (e *execInSession) detach(d Docker) error {
+	if e.cw == nil {
+		return errors.New("dexec: exec is not started")
+	}
+	e.detachOnce.Do(func() { close(e.detached) })
+	return e.cw.Close()
+}
+
+func (e *execInSession) isDetached() bool {
+	select {
+	case <-e.detached:
+		return true
+	default:
+		return false
+	}
+}
+
+func (e *execInSession) setEnv(env []string) error {
+	e.env = env
+	return nil
+}
+
+func (e *execInSession) setInheritedEnv(env []string) error {
+	e.env = mergeEnv(e.env, env)
+	return nil
+}
+
+func (e *execInSession) setDir(dir string) error {
+	if !path.IsAbs(dir) {
+		return fmt.Errorf("dexec: Dir must be an absolute path: %q", dir)
+	}
+	e.dir = dir
+	return nil
+}
+
+func (e *execInSession) setNoStdin(noStdin bool) error {
+	e.noStdin = noStdin
+	return nil
+}
+
+// unsupportedInSession implements the parts of Execution that do not apply to
+// commands run in a Session.
+type unsupportedInSession struct{}
+
+func notInSession(feature string) error {
+	return fmt.Errorf("dexec: %s is not supported for Session commands", feature)
+}
+
+func (unsupportedInSession) inspect(Docker) (ContainerInfo, error) {
+	return ContainerInfo{}, notInSession("Inspect")
+}
+
+func (unsupportedInSession) finalState() (State, error) {
+	return State{}, notInSession("FinalState")
+}
+
+func (unsupportedInSession) changes(Docker) ([]FileChange, error) {
+	return nil, notInSession("Changes")
+}
+
+func (unsupportedInSession) signal(Docker, syscall.Signal) error {
+	return notInSession("Signal")
+}
+
+func (unsupportedInSession) kill(Docker) error {
+	return notInSession("Kill")
+}
+
+func (unsupportedInSession) resize(Docker, uint16, uint16) error {
+	return notInSession("Resize")
+}
+
+func (unsupportedInSession) setKeep(bool) error {
+	return notInSession("KeepContainer")
+}
+
+func (unsupportedInSession) setKeepKilled(bool) error {
+	return notInSession("KeepKilledContainer")
+}
+
+func (unsupportedInSession) setRequireDigest(bool) error {
+	return notInSession("RequireDigest")
+}
+
+func (unsupportedInSession) setCheckBindSources(bool) error {
+	return notInSession("CheckBindSources")
+}
+
+func (unsupportedInSession) setRequireNativePlatform(bool) error {
+	return notInSession("RequireNativePlatform")
+}
+
+func (unsupportedInSession) setEventHandler(func(ContainerEvent)) error {
+	return notInSession("OnEvent")
+}
+
+func (unsupportedInSession) setCleanupErrorHook(func(string, error)) error {
+	return notInSession("OnCleanupError")
+}
+
+func (unsupportedInSession) setStopTimeout(time.Duration) error {
+	return notInSession("StopTimeout")
+}
+
+func (unsupportedInSession) setKeepEntrypoint(bool) error {
+	return notInSession("KeepEntrypoint")
+}
+
+func (unsupportedInSession) setAttachTimeout(time.Duration) error {
+	return notInSession("AttachTimeout")
+}
+
+func (unsupportedInSession) setSecrets([]Secret) error {
+	return notInSession("Secrets")
+}
+
+func (unsupportedInSession) setDetachKeys(string) error {
+	return notInSession("DetachKeys")
+}
+
+func (unsupportedInSession) setTerminalSize(uint16, uint16) error {
+	return notInSession("TTYWidth and TTYHeight")
+}
+
+func (unsupportedInSession) setIdleTimeout(time.Duration) error {
+	return notInSession("IdleTimeout")
+}
+
+func (unsupportedInSession) setStdinEOFTimeout(time.Duration) error {
+	return notInSession("StdinEOFTimeout")
+}
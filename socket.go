@@ -0,0 +1,35 @@
+package dexec
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// SocketBind returns a bind for HostConfig.Binds that makes the Unix socket at
+// src on the host available at dest in the container, such as for tools that
+// talk to a host daemon. It checks that src exists and is a socket, which is
+// only meaningful if the Docker engine runs on the same host; for a remote
+// engine, write the bind as "src:dest" instead.
+//
+// Access to a socket gives the command whatever the daemon behind it allows.
+// Binding the Docker socket in particular lets the command start privileged
+// containers and thereby gain root access to the host. A read-only bind does
+// not restrict this, since connecting to a socket does not write to it.
+func SocketBind(src, dest string) (string, error) {
+	if !filepath.IsAbs(src) {
+		return "", fmt.Errorf("dexec: socket path must be absolute: %q", src)
+	}
+	if !path.IsAbs(dest) {
+		return "", fmt.Errorf("dexec: socket target must be an absolute path: %q", dest)
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return "", fmt.Errorf("dexec: cannot bind socket: %v", err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return "", fmt.Errorf("dexec: not a socket: %q", src)
+	}
+	return src + ":" + dest, nil
+}
@@ -0,0 +1,53 @@
+package dexec
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSocketBind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexec-socket-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "daemon.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := SocketBind(sock, "/run/daemon.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sock + ":/run/daemon.sock"; b != want {
+		t.Fatalf("got %q; expected %q", b, want)
+	}
+	if err := validateBind(b); err != nil {
+		t.Fatalf("invalid bind: %v", err)
+	}
+
+	for _, tt := range []struct {
+		src, dest, err string
+	}{
+		{"daemon.sock", "/run/daemon.sock", "socket path must be absolute"},
+		{sock, "run/daemon.sock", "socket target must be an absolute path"},
+		{filepath.Join(dir, "missing"), "/run/daemon.sock", "cannot bind socket"},
+		{file, "/run/daemon.sock", "not a socket"},
+	} {
+		if _, err := SocketBind(tt.src, tt.dest); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("SocketBind(%q, %q) = %v; expected error containing %q", tt.src, tt.dest, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package dexec
+
+import "fmt"
+
+// streamMode is how a standard stream of a Cmd was configured, which is
+// reported when another method tries to configure it again.
+type streamMode int
+
+const (
+	streamUnset    streamMode = iota
+	streamUser                // assigned to the field by the caller
+	streamPipe                // StdinPipe, StdoutPipe, StderrPipe or CombinedOutputReader
+	streamCapture             // Output, CombinedOutput, SeparatedOutput or ExecuteAndWait
+	streamFile                // SetStdinFile
+	streamCloser              // SetStdoutCloser or SetStderrCloser
+	streamTerminal            // ServeTerminal
+)
+
+func (m streamMode) describe(stream string) string {
+	switch m {
+	case streamPipe:
+		return "a pipe"
+	case streamCapture:
+		return "captured output"
+	case streamFile:
+		return "a file"
+	case streamCloser:
+		return "a closing writer"
+	case streamTerminal:
+		return "a terminal"
+	}
+	if stream == "Stdin" {
+		return "a reader"
+	}
+	return "a writer"
+}
+
+// configureStream records that method configures the named stream ("Stdin",
+// "Stdout" or "Stderr") as mode, or returns an error naming how the stream is
+// already configured if it is set.
+func (c *Cmd) configureStream(stream, method string, mode streamMode) error {
+	var set bool
+	var m *streamMode
+	switch stream {
+	case "Stdin":
+		set, m = c.Stdin != nil, &c.stdinMode
+	case "Stdout":
+		set, m = c.Stdout != nil, &c.stdoutMode
+	default:
+		set, m = c.Stderr != nil, &c.stderrMode
+	}
+	if !set {
+		*m = mode
+		return nil
+	}
+	if *m == streamUnset {
+		*m = streamUser
+	}
+	return fmt.Errorf("dexec: %s already configured as %s; cannot use %s", stream, m.describe(stream), method)
+}
@@ -0,0 +1,52 @@
+package dexec
+
+import "io"
+
+// TerminalSize is the size of a terminal in characters.
+type TerminalSize struct {
+	Cols, Rows uint16
+}
+
+// ServeTerminal runs cmd as an interactive terminal session over conn, such as
+// a WebSocket connection of a web terminal wrapped in an io.ReadWriter. Input
+// read from conn is written to the terminal of the command and its output is
+// written to conn. The terminal is resized to each size received from sizes,
+// which the caller typically decodes from control messages on the same
+// connection; sizes may be nil.
+//
+// The options of cmd.Method must have Config.Tty set, and cmd must not have
+// Stdin, Stdout or Stderr set or be started. ServeTerminal returns once the
+// command exits, with the same result as Wait. A read from conn may still be
+// pending then; the caller should close the connection to end it.
+func ServeTerminal(cmd *Cmd, conn io.ReadWriter, sizes <-chan TerminalSize) error {
+	for _, stream := range []string{"Stdin", "Stdout", "Stderr"} {
+		if err := cmd.configureStream(stream, "ServeTerminal", streamTerminal); err != nil {
+			return err
+		}
+	}
+	cmd.Stdin = conn
+	cmd.Stdout = conn
+	cmd.Stderr = conn // unused by Docker with a terminal
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case s, ok := <-sizes:
+				if !ok {
+					return
+				}
+				// the command may exit at any time; failing to resize is
+				// not worth ending the session for
+				cmd.Resize(s.Cols, s.Rows)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return cmd.Wait()
+}
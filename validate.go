@@ -0,0 +1,294 @@
+package dexec
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// sysctlName matches dot-separated kernel parameter names such as
+// "net.ipv4.ip_unprivileged_port_start".
+var sysctlName = regexp.MustCompile(`^[a-z0-9_-]+(\.[a-zA-Z0-9_-]+)+$`)
+
+// hostnameLabel matches a single RFC 1123 hostname label.
+var hostnameLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// signalNames are the signals accepted by name for Config.StopSignal, with or
+// without the "SIG" prefix.
+var signalNames = map[string]bool{
+	"HUP": true, "INT": true, "QUIT": true, "ILL": true, "TRAP": true,
+	"ABRT": true, "BUS": true, "FPE": true, "KILL": true, "USR1": true,
+	"SEGV": true, "USR2": true, "PIPE": true, "ALRM": true, "TERM": true,
+	"STKFLT": true, "CHLD": true, "CONT": true, "STOP": true, "TSTP": true,
+	"TTIN": true, "TTOU": true, "URG": true, "XCPU": true, "XFSZ": true,
+	"VTALRM": true, "PROF": true, "WINCH": true, "IO": true, "PWR": true,
+	"SYS": true,
+}
+
+// validateOptions checks the container options given to ByCreatingContainer
+// and reports all problems found at once.
+func validateOptions(opts docker.CreateContainerOptions) error {
+	if opts.Config == nil {
+		return errors.New("dexec: Config is nil")
+	}
+	var errs optionErrors
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if opts.Config.Image == "" {
+		add(errors.New("dexec: Config.Image is empty"))
+	}
+	if h := opts.Config.Hostname; h != "" {
+		add(validateHostname(h))
+	}
+	if sig := opts.Config.StopSignal; sig != "" {
+		add(validateSignal(sig))
+	}
+	if hc := opts.HostConfig; hc != nil {
+		for _, b := range hc.Binds {
+			add(validateBind(b))
+		}
+		for i, m := range hc.Mounts {
+			if o := m.BindOptions; o != nil && o.Propagation != "" && !propagationModes[o.Propagation] {
+				add(fmt.Errorf("dexec: invalid HostConfig.Mounts[%d].BindOptions.Propagation %q", i, o.Propagation))
+			}
+		}
+		names := make([]string, 0, len(hc.Sysctls))
+		for k := range hc.Sysctls {
+			names = append(names, k)
+		}
+		sort.Strings(names) // for a stable error
+		for _, k := range names {
+			if !sysctlName.MatchString(k) {
+				add(fmt.Errorf("dexec: invalid sysctl name: %q", k))
+			}
+		}
+		for _, h := range hc.ExtraHosts {
+			add(validateExtraHost(h))
+		}
+		add(validateCPUSet("CPUSetCPUs", hc.CPUSetCPUs))
+		add(validateCPUSet("CPUSetMEMs", hc.CPUSetMEMs))
+		add(validateMemory(hc))
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return errs
+}
+
+// optionErrors reports multiple problems with container options.
+type optionErrors []error
+
+func (e optionErrors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = strings.TrimPrefix(err.Error(), "dexec: ")
+	}
+	return fmt.Sprintf("dexec: %d invalid options: %s", len(e), strings.Join(s, "; "))
+}
+
+// validateCPUSet checks that a cpuset, if set, is a comma-separated list of
+// numbers and ascending ranges of numbers, such as "0-3,5".
+func validateCPUSet(field, set string) error {
+	if set == "" {
+		return nil
+	}
+	for _, r := range strings.Split(set, ",") {
+		parts := strings.SplitN(r, "-", 2)
+		lo, err := strconv.ParseUint(parts[0], 10, 16)
+		hi := lo
+		if err == nil && len(parts) == 2 {
+			hi, err = strconv.ParseUint(parts[1], 10, 16)
+		}
+		if err != nil || hi < lo {
+			return fmt.Errorf("dexec: invalid HostConfig.%s %q (expected e.g. 0-3,5)", field, set)
+		}
+	}
+	return nil
+}
+
+// validateMemory checks the swap settings against the memory limit. Docker
+// takes MemorySwap as the limit of memory plus swap, with -1 for unlimited
+// swap, and MemorySwappiness as a percentage, with -1 for the default.
+func validateMemory(hc *docker.HostConfig) error {
+	switch {
+	case hc.MemorySwap < -1:
+		return fmt.Errorf("dexec: invalid HostConfig.MemorySwap: %d", hc.MemorySwap)
+	case hc.MemorySwap > 0 && hc.Memory <= 0:
+		return errors.New("dexec: HostConfig.MemorySwap requires HostConfig.Memory")
+	case hc.MemorySwap > 0 && hc.MemorySwap < hc.Memory:
+		return fmt.Errorf("dexec: HostConfig.MemorySwap (%d) is less than HostConfig.Memory (%d)", hc.MemorySwap, hc.Memory)
+	}
+	if p := hc.MemorySwappiness; p != nil && (*p < -1 || *p > 100) {
+		return fmt.Errorf("dexec: invalid HostConfig.MemorySwappiness: %d (expected 0-100)", *p)
+	}
+	return nil
+}
+
+// bindOptions are the comma-separated options Docker accepts on binds, besides
+// propagationModes.
+var bindOptions = map[string]bool{
+	"ro": true, "rw": true,
+	"z": true, "Z": true, "nocopy": true,
+	"consistent": true, "cached": true, "delegated": true,
+}
+
+// propagationModes are the mount propagation modes of binds and bind mounts.
+var propagationModes = map[string]bool{
+	"shared": true, "rshared": true,
+	"slave": true, "rslave": true,
+	"private": true, "rprivate": true,
+}
+
+// validateBind checks that a bind is in "src:dest[:options]" form with an
+// absolute container path and known options.
+func validateBind(b string) error {
+	parts := strings.Split(b, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || !path.IsAbs(parts[1]) {
+		return fmt.Errorf("dexec: invalid bind %q (expected src:dest[:options])", b)
+	}
+	if len(parts) == 3 {
+		for _, o := range strings.Split(parts[2], ",") {
+			if !bindOptions[o] && !propagationModes[o] {
+				return fmt.Errorf("dexec: invalid bind %q: unknown option %q", b, o)
+			}
+		}
+	}
+	return nil
+}
+
+// validateHostname checks that h is a valid RFC 1123 hostname.
+func validateHostname(h string) error {
+	if len(h) > 253 {
+		return fmt.Errorf("dexec: invalid hostname %q: too long", h)
+	}
+	for _, l := range strings.Split(h, ".") {
+		if !hostnameLabel.MatchString(l) {
+			return fmt.Errorf("dexec: invalid hostname %q", h)
+		}
+	}
+	return nil
+}
+
+// validateSignal checks that sig is a known signal name, such as "SIGQUIT" or
+// "QUIT", a real-time signal name, such as "SIGRTMIN+3", or a signal number.
+func validateSignal(sig string) error {
+	if n, err := strconv.Atoi(sig); err == nil {
+		if n < 1 || n > maxSignal {
+			return fmt.Errorf("dexec: invalid signal %q", sig)
+		}
+		return nil
+	}
+	name := strings.TrimPrefix(strings.ToUpper(sig), "SIG")
+	if !signalNames[name] && !isRealtimeSignal(name) {
+		return fmt.Errorf("dexec: invalid signal %q", sig)
+	}
+	return nil
+}
+
+// isRealtimeSignal reports whether name is a real-time signal name accepted
+// by Docker: "RTMIN", "RTMIN+1" to "RTMIN+15", "RTMAX-14" to "RTMAX-1" or
+// "RTMAX".
+func isRealtimeSignal(name string) bool {
+	for _, r := range []struct {
+		prefix string
+		max    uint64
+	}{{"RTMIN+", 15}, {"RTMAX-", 14}} {
+		if strings.HasPrefix(name, r.prefix) {
+			n, err := strconv.ParseUint(name[len(r.prefix):], 10, 8)
+			return err == nil && n >= 1 && n <= r.max
+		}
+	}
+	return name == "RTMIN" || name == "RTMAX"
+}
+
+// validateExtraHost checks that an /etc/hosts entry is in "host:ip" form. The
+// special "host-gateway" value understood by Docker is accepted as the ip.
+func validateExtraHost(h string) error {
+	parts := strings.SplitN(h, ":", 2)
+	if len(parts) != 2 || parts[0] == "" ||
+		(parts[1] != "host-gateway" && net.ParseIP(parts[1]) == nil) {
+		return fmt.Errorf("dexec: invalid extra host %q (expected host:ip)", h)
+	}
+	return nil
+}
+
+// validateDetachKeys checks a detach key sequence in the format accepted by
+// Docker: a comma-separated list of single characters or "ctrl-<value>",
+// where <value> is a letter or one of @, [, \, ], ^ or _.
+func validateDetachKeys(keys string) error {
+	for _, k := range strings.Split(keys, ",") {
+		if len(k) == 1 {
+			continue
+		}
+		v := strings.TrimPrefix(strings.ToLower(k), "ctrl-")
+		if len(v) != 1 || len(v) == len(k) || !(v[0] >= 'a' && v[0] <= 'z' || strings.Contains("@[\\]^_", v)) {
+			return fmt.Errorf("dexec: invalid detach key %q", k)
+		}
+	}
+	return nil
+}
+
+// detachKeyBytes returns the bytes of a detach key sequence that passed
+// validateDetachKeys, as typed on a terminal.
+func detachKeyBytes(keys string) []byte {
+	var b []byte
+	for _, k := range strings.Split(keys, ",") {
+		if len(k) == 1 {
+			b = append(b, k[0])
+			continue
+		}
+		b = append(b, strings.ToUpper(k[len(k)-1:])[0]&0x1f)
+	}
+	return b
+}
+
+// MountSourceError is returned by Cmd.Start if Cmd.CheckBindSources is set and
+// the host path of a bind mount does not exist.
+type MountSourceError struct {
+	// Source is the missing host path.
+	Source string
+}
+
+func (e *MountSourceError) Error() string {
+	return fmt.Sprintf("dexec: bind mount source does not exist: %q", e.Source)
+}
+
+// checkBindSources checks that the host paths of binds and bind mounts exist.
+// Sources in HostConfig.Binds which are not absolute paths name volumes and
+// are not checked.
+func checkBindSources(hc *docker.HostConfig) error {
+	if hc == nil {
+		return nil
+	}
+	var sources []string
+	for _, b := range hc.Binds {
+		if src := strings.SplitN(b, ":", 2)[0]; path.IsAbs(src) {
+			sources = append(sources, src)
+		}
+	}
+	for _, m := range hc.Mounts {
+		if m.Type == "bind" {
+			sources = append(sources, m.Source)
+		}
+	}
+	for _, src := range sources {
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			return &MountSourceError{Source: src}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package dexec
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+func TestCheckBindSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexec-binds-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	missing := filepath.Join(dir, "missing")
+
+	for _, tt := range []struct {
+		hc      *docker.HostConfig
+		missing string
+	}{
+		{nil, ""},
+		{&docker.HostConfig{Binds: []string{dir + ":/data:ro", "volume:/cache"}}, ""},
+		{&docker.HostConfig{Mounts: []docker.HostMount{{Type: "bind", Source: dir, Target: "/data"}}}, ""},
+		{&docker.HostConfig{Mounts: []docker.HostMount{{Type: "volume", Source: "missing", Target: "/data"}}}, ""},
+		{&docker.HostConfig{Binds: []string{dir + ":/data", missing + ":/missing"}}, missing},
+		{&docker.HostConfig{Mounts: []docker.HostMount{{Type: "bind", Source: missing, Target: "/data"}}}, missing},
+	} {
+		err := checkBindSources(tt.hc)
+		if tt.missing == "" {
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			continue
+		}
+		if e, ok := err.(*MountSourceError); !ok || e.Source != tt.missing {
+			t.Errorf("got error %v; expected source %q to be reported", err, tt.missing)
+		}
+	}
+}
+
+func TestValidateOptionsReportsAll(t *testing.T) {
+	err := validateOptions(docker.CreateContainerOptions{
+		Config: &docker.Config{Image: "busybox", StopSignal: "SIGFOO"},
+		HostConfig: &docker.HostConfig{
+			Binds:      []string{"/tmp"},
+			CPUSetCPUs: "3-1",
+		},
+	})
+	want := `dexec: 3 invalid options: invalid signal "SIGFOO"; ` +
+		`invalid bind "/tmp" (expected src:dest[:options]); ` +
+		`invalid HostConfig.CPUSetCPUs "3-1" (expected e.g. 0-3,5)`
+	if err == nil || err.Error() != want {
+		t.Errorf("validateOptions() = %v, want %q", err, want)
+	}
+}
+
+func TestValidateMountPropagation(t *testing.T) {
+	for _, tt := range []struct {
+		propagation string
+		err         string
+	}{
+		{"", ""},
+		{"rslave", ""},
+		{"rprivate", ""},
+		{"slave,ro", `dexec: invalid HostConfig.Mounts[0].BindOptions.Propagation "slave,ro"`},
+		{"ro", `dexec: invalid HostConfig.Mounts[0].BindOptions.Propagation "ro"`},
+	} {
+		err := validateOptions(docker.CreateContainerOptions{
+			Config: &docker.Config{Image: "busybox"},
+			HostConfig: &docker.HostConfig{Mounts: []docker.HostMount{{
+				Type:        "bind",
+				Source:      "/tmp",
+				Target:      "/data",
+				BindOptions: &docker.BindOptions{Propagation: tt.propagation},
+			}}},
+		})
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("%q: validateOptions() = %v, want %q", tt.propagation, err, tt.err)
+		}
+	}
+}